@@ -0,0 +1,162 @@
+/*
+* ack.go
+*
+* Acknowledgement of received messages to the broker.
+*
+* By default a service acknowledges every message as soon as it arrives.  In the AckManual mode, requests, alerts, and infos
+* are only acknowledged when their handler calls Ack, so that a message whose handler fails is delivered again.
+* Requests handled by endpoints are acknowledged by the service once the endpoint has finished.
+ */
+
+package dripline
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// AckMode determines when received messages are acknowledged to the broker.
+type AckMode int
+
+const (
+	// AckOnReceipt acknowledges each message as soon as it is received.
+	AckOnReceipt AckMode = iota
+	// AckManual leaves the acknowledgement of requests, alerts, and infos to their handlers; replies are still acknowledged on receipt.
+	AckManual
+)
+
+// deliveryCountHeader is set by the broker on messages from quorum queues
+const deliveryCountHeader = "x-delivery-count"
+
+// deliveryAck settles the broker deliveries that make up a received message; a chunked message has one delivery per part.
+// Only the first settlement has an effect.
+type deliveryAck struct {
+	once              sync.Once
+	service           *AmqpService
+	deliveries        []amqp.Delivery
+}
+
+// Ack acknowledges the message to the broker, so that it is not delivered again.
+// In the AckOnReceipt mode, and for replies, the message has already been acknowledged and Ack does nothing.
+// Only the first call of Ack, Nack, or Reject on a message has an effect.
+func (message *Message) Ack() error {
+	return (*message).ack.settle(func(delivery amqp.Delivery) error { return delivery.Ack(false) }, true)
+}
+
+// Nack tells the broker that the message was not handled.
+// With requeue, the message will be delivered again, unless it has already been redelivered MaxRedeliveries times;
+// without requeue, it is discarded, or dead-lettered if the queue has a dead-letter exchange.
+func (message *Message) Nack(requeue bool) error {
+	return (*message).ack.settle(func(delivery amqp.Delivery) error { return delivery.Nack(false, requeue) }, requeue == false)
+}
+
+// Reject refuses the message; requeue has the same meaning as for Nack.
+func (message *Message) Reject(requeue bool) error {
+	return (*message).ack.settle(func(delivery amqp.Delivery) error { return delivery.Reject(requeue) }, requeue == false)
+}
+
+// newDeliveryAck creates the acknowledgement handle for a message in the AckManual mode; in the AckOnReceipt mode there is none.
+func (service *AmqpService) newDeliveryAck(deliveries []amqp.Delivery) (ack *deliveryAck) {
+	if service.AckMode != AckManual {
+		return
+	}
+	ack = &deliveryAck{service: service, deliveries: deliveries}
+	return
+}
+
+// settle applies an acknowledgement to every delivery of a message; final means that the broker will not deliver the message again.
+func (ack *deliveryAck) settle(apply func(amqp.Delivery) error, final bool) (e error) {
+	if ack == nil {
+		return
+	}
+	ack.once.Do(func() {
+		for _, delivery := range ack.deliveries {
+			if final {
+				ack.service.forgetRedeliveries(delivery)
+			}
+			if applyErr := apply(delivery); applyErr != nil && e == nil {
+				e = fmt.Errorf("Unable to acknowledge the message: %v", applyErr)
+			}
+		}
+	})
+	return
+}
+
+// settleDeliveries acknowledges or rejects deliveries that the service has finished with itself, such as the parts of a chunked message
+// that could not be reassembled.  It does nothing in the AckOnReceipt mode.
+func (service *AmqpService) settleDeliveries(deliveries []amqp.Delivery, handled bool) {
+	ack := service.newDeliveryAck(deliveries)
+	var settleErr error
+	if handled {
+		settleErr = ack.settle(func(delivery amqp.Delivery) error { return delivery.Ack(false) }, true)
+	} else {
+		settleErr = ack.settle(func(delivery amqp.Delivery) error { return delivery.Reject(false) }, true)
+	}
+	logSettleError(settleErr)
+	return
+}
+
+func logSettleError(settleErr error) {
+	if settleErr != nil {
+		logging.Log.Warningf("%v", settleErr)
+	}
+	return
+}
+
+// redeliveryKey identifies a delivery across redeliveries, by message ID, or else by correlation ID and chunk index.
+// A delivery with neither ID is identified by a hash of its routing key and body, so that only identical messages share a count.
+func redeliveryKey(delivery amqp.Delivery) string {
+	if delivery.MessageId != "" {
+		return "id:" + delivery.MessageId
+	}
+	if delivery.CorrelationId != "" {
+		return fmt.Sprintf("corr:%s:%v", delivery.CorrelationId, delivery.Headers[ChunkIndexHeader])
+	}
+	hash := sha256.New()
+	hash.Write([]byte(delivery.Exchange + "\x00" + delivery.RoutingKey + "\x00"))
+	hash.Write(delivery.Body)
+	return fmt.Sprintf("body:%x", hash.Sum(nil))
+}
+
+// countRedelivery returns the number of times a delivery has been redelivered.
+// Quorum queues report the count in a header; otherwise the service counts the redeliveries that it has seen.
+func (service *AmqpService) countRedelivery(delivery amqp.Delivery) (count int) {
+	if countIfc, hasCount := delivery.Headers[deliveryCountHeader]; hasCount {
+		if headerCount, convErr := ConvertToMsgCode(countIfc); convErr == nil {
+			count = int(headerCount)
+			return
+		}
+	}
+	if delivery.Redelivered == false {
+		return
+	}
+	key := redeliveryKey(delivery)
+	service.redeliveryLock.Lock()
+	defer service.redeliveryLock.Unlock()
+	service.redeliveries[key]++
+	count = service.redeliveries[key]
+	return
+}
+
+// forgetRedeliveries stops counting the redeliveries of a delivery that has been settled for good.
+func (service *AmqpService) forgetRedeliveries(delivery amqp.Delivery) {
+	service.redeliveryLock.Lock()
+	delete(service.redeliveries, redeliveryKey(delivery))
+	service.redeliveryLock.Unlock()
+	return
+}
+
+// redeliveryExceeded reports whether a delivery has been redelivered more than MaxRedeliveries times, in the AckManual mode.
+func (service *AmqpService) redeliveryExceeded(delivery amqp.Delivery) (exceeded bool) {
+	if service.AckMode != AckManual || service.MaxRedeliveries <= 0 {
+		return
+	}
+	count := service.countRedelivery(delivery)
+	exceeded = count > service.MaxRedeliveries
+	return
+}
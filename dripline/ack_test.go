@@ -0,0 +1,119 @@
+/*
+* ack_test.go
+*
+* Tests of the manual acknowledgement of messages, and of the limit on redeliveries.
+ */
+
+package dripline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRedeliveryKey(t *testing.T) {
+	withId := amqp.Delivery{MessageId: "id", CorrelationId: "corr", Body: []byte("a")}
+	if redeliveryKey(withId) != redeliveryKey(amqp.Delivery{MessageId: "id", Body: []byte("b")}) {
+		t.Errorf("Deliveries with the same message ID have different keys")
+	}
+	part := amqp.Delivery{CorrelationId: "corr", Headers: amqp.Table{ChunkIndexHeader: int64(1)}}
+	if redeliveryKey(part) == redeliveryKey(amqp.Delivery{CorrelationId: "corr", Headers: amqp.Table{ChunkIndexHeader: int64(2)}}) {
+		t.Errorf("Parts of a chunked message have the same key")
+	}
+	if redeliveryKey(amqp.Delivery{MessageId: "corr"}) == redeliveryKey(amqp.Delivery{CorrelationId: "corr"}) {
+		t.Errorf("A message ID and a correlation ID have the same key")
+	}
+
+	first := amqp.Delivery{RoutingKey: "sensor", Body: []byte("a")}
+	if redeliveryKey(first) != redeliveryKey(amqp.Delivery{RoutingKey: "sensor", Body: []byte("a")}) {
+		t.Errorf("Identical deliveries without IDs have different keys")
+	}
+	for _, other := range []amqp.Delivery{{RoutingKey: "sensor", Body: []byte("b")}, {RoutingKey: "pump", Body: []byte("a")}} {
+		if redeliveryKey(first) == redeliveryKey(other) {
+			t.Errorf("Different deliveries without IDs have the same key %s", redeliveryKey(first))
+		}
+	}
+}
+
+// publishAlert publishes an alert without a message ID or correlation ID, as a sender that does not set them would.
+func publishAlert(t *testing.T, transport Transport, target string, payload interface{}) {
+	t.Helper()
+	alert := PrepareAlert(target, "application/json", SenderInfo{})
+	alert.Payload = payload
+	body, e := alert.Encode()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = transport.Publish("alerts", target, true, amqp.Publishing{ContentEncoding: "application/json", Body: body}); e != nil {
+		t.Fatal(e)
+	}
+	return
+}
+
+// handleAlerts receives alerts in rounds, and counts the deliveries of each payload.  The alerts of a round are all received
+// before any of them is handled, so that they are in flight together; the rounds end when no alert arrives for a while.
+func handleAlerts(service *AmqpService, handle func(alert Alert, delivered int)) (deliveries map[interface{}]int) {
+	deliveries = make(map[interface{}]int)
+	for {
+		var round []Alert
+		for waiting := true; waiting; {
+			select {
+			case alert := <-service.Receiver.AlertChan:
+				round = append(round, alert)
+			case <-time.After(200 * time.Millisecond):
+				waiting = false
+			}
+		}
+		if len(round) == 0 {
+			return
+		}
+		for _, alert := range round {
+			deliveries[alert.Payload]++
+			handle(alert, deliveries[alert.Payload])
+		}
+	}
+}
+
+func TestMemoryManualAck(t *testing.T) {
+	broker := NewMemoryBroker()
+	listener := newTestService(t, broker, "listener", func(service *AmqpService) {
+		service.AckMode = AckManual
+		service.MaxRedeliveries = 1
+	})
+	if e := listener.SubscribeToAlerts("sensor.#"); e != nil {
+		t.Fatal(e)
+	}
+	transport := broker.NewTransport()
+	if e := transport.Dial(""); e != nil {
+		t.Fatal(e)
+	}
+	defer transport.Close()
+
+	// alerts that always fail are given up after MaxRedeliveries redeliveries; alerts without IDs are counted separately
+	publishAlert(t, transport, "sensor.a", "a")
+	publishAlert(t, transport, "sensor.b", "b")
+	deliveries := handleAlerts(listener, func(alert Alert, delivered int) {
+		alert.Nack(true)
+	})
+	if deliveries["a"] != 2 || deliveries["b"] != 2 {
+		t.Errorf("Alerts that always fail were delivered %v times, expected twice each", deliveries)
+	}
+
+	// an alert that fails once is delivered again, and is then acknowledged
+	publishAlert(t, transport, "sensor.c", "c")
+	deliveries = handleAlerts(listener, func(alert Alert, delivered int) {
+		if delivered == 1 {
+			alert.Nack(true)
+		} else {
+			alert.Ack()
+		}
+	})
+	if deliveries["c"] != 2 {
+		t.Errorf("Alert that failed once was delivered %d times, expected 2", deliveries["c"])
+	}
+	if len(listener.redeliveries) != 0 {
+		t.Errorf("Redelivery counts are left for settled messages: %v", listener.redeliveries)
+	}
+}
@@ -0,0 +1,34 @@
+/*
+* call.go
+*
+* Typed request/reply helpers
+ */
+
+package dripline
+
+import (
+	"context"
+)
+
+// Call sends a request with a payload of type Req to target, waits for the Reply, and decodes the reply's payload into a Resp.
+// A reply with a RetCode other than RCSuccess is returned as a *DriplineError, and a payload that does not fit Resp as an RCErrDripPayload error.
+// Waiting for the reply is bounded by ctx, as in SendRequestContext.
+func Call[Req any, Resp any](ctx context.Context, service *AmqpService, target string, op MsgCodeT, req Req) (resp Resp, e error) {
+	request := PrepareRequest(target, service.Encoding, op, service.senderInfo)
+	if e = request.SetPayload(req); e != nil {
+		return
+	}
+
+	reply, e := service.SendRequestContext(ctx, request)
+	if e != nil {
+		return
+	}
+	if e = reply.Err(); e != nil {
+		return
+	}
+
+	if reply.Payload != nil {
+		e = reply.DecodePayload(&resp)
+	}
+	return
+}
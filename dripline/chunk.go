@@ -0,0 +1,267 @@
+/*
+* chunk.go
+*
+* Chunked transfer of messages that are too large to send in one piece.
+*
+* The encoded (and possibly compressed) body of a large message is split into parts, which are published in order as separate messages.
+* Every part has the properties and headers of the whole message, including its correlation ID,
+* plus headers giving the part's index, the number of parts, and the size of the whole body.
+* The receiver collects the parts by correlation ID and decodes the message once all of them have arrived.
+ */
+
+package dripline
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// Headers of the parts of a chunked message
+const (
+	ChunkIndexHeader = "chunk_index"
+	ChunkCountHeader = "chunk_count"
+	ChunkTotalHeader = "chunk_total_size"
+)
+
+// ChunkPolicy controls the splitting of large outgoing messages into parts, and the reassembly of incoming ones.
+// Chunked messages are always reassembled; outgoing messages are only split if Size is positive.
+type ChunkPolicy struct {
+	// Size is the largest body that is sent in one message; larger bodies are split into parts of this size
+	Size              int
+	// Timeout is how long the parts of an incomplete message are kept
+	Timeout           time.Duration
+	// MaxMessageSize is the largest body that is reassembled
+	MaxMessageSize    int
+	// MaxPendingSize limits the total size of the incomplete messages being reassembled
+	MaxPendingSize    int
+}
+
+// splitPublishing splits a publishing into parts with bodies of at most size bytes.
+// A publishing that does not need to be split is returned as is.
+func splitPublishing(publishing amqp.Publishing, size int) (parts []amqp.Publishing) {
+	if size <= 0 || len(publishing.Body) <= size {
+		parts = []amqp.Publishing{publishing}
+		return
+	}
+
+	count := (len(publishing.Body) + size - 1) / size
+	parts = make([]amqp.Publishing, 0, count)
+	for index := 0; index < count; index++ {
+		part := publishing
+		part.Headers = make(amqp.Table, len(publishing.Headers) + 3)
+		for header, value := range publishing.Headers {
+			part.Headers[header] = value
+		}
+		part.Headers[ChunkIndexHeader] = int64(index)
+		part.Headers[ChunkCountHeader] = int64(count)
+		part.Headers[ChunkTotalHeader] = int64(len(publishing.Body))
+
+		end := (index + 1) * size
+		if end > len(publishing.Body) {
+			end = len(publishing.Body)
+		}
+		part.Body = publishing.Body[index * size : end]
+		parts = append(parts, part)
+	}
+	return
+}
+
+// chunkAssembler collects the parts of chunked messages.
+// The deliveries of parts that it discards, or that duplicate parts it already has, are passed to settle, if there is one.
+type chunkAssembler struct {
+	lock              sync.Mutex
+	transfers         map[string]*chunkTransfer
+	pendingSize       int
+	settle            func(deliveries []amqp.Delivery, handled bool)
+}
+
+// chunkTransfer is a chunked message whose parts are still arriving.
+// The parts are kept by index as they arrive, so nothing is allocated for the parts that a sender only claims to have.
+type chunkTransfer struct {
+	parts             map[int][]byte
+	count             int
+	received          int
+	size              int
+	totalSize         int
+	first             amqp.Delivery
+	deliveries        []amqp.Delivery
+	timer             *time.Timer
+}
+
+func newChunkAssembler(settle func(deliveries []amqp.Delivery, handled bool)) (assembler *chunkAssembler) {
+	assembler = &chunkAssembler {
+		transfers: make(map[string]*chunkTransfer),
+		settle:    settle,
+	}
+	return
+}
+
+// add takes in a delivery; if it is a part of a chunked message, it is kept until the message is complete.
+// The returned delivery is the whole message, and parts are the deliveries that it was assembled from; both are only valid if complete is true.
+// A part that is inconsistent with the others, or that would exceed the size limits, ends the transfer with an error.
+func (assembler *chunkAssembler) add(delivery amqp.Delivery, policy ChunkPolicy) (message amqp.Delivery, parts []amqp.Delivery, complete bool, e error) {
+	if _, isPart := delivery.Headers[ChunkCountHeader]; isPart == false {
+		message, parts, complete = delivery, []amqp.Delivery{delivery}, true
+		return
+	}
+	// a part that was kept is given up with its transfer
+	kept := false
+	defer func() {
+		if e != nil && kept == false {
+			assembler.settleParts([]amqp.Delivery{delivery}, false)
+		}
+	}()
+
+	var index, count, totalSize int
+	for _, header := range []struct {
+		name  string
+		value *int
+	}{
+		{ChunkIndexHeader, &index},
+		{ChunkCountHeader, &count},
+		{ChunkTotalHeader, &totalSize},
+	} {
+		value, convErr := ConvertToMsgCode(delivery.Headers[header.name])
+		if convErr == nil && value > math.MaxInt {
+			convErr = fmt.Errorf("value %d is out of range", value)
+		}
+		if convErr != nil {
+			e = Errorf(RCErrDripPayload, "Invalid %s header: %v", header.name, convErr)
+			return
+		}
+		*header.value = int(value)
+	}
+	key := delivery.CorrelationId
+	switch {
+	case key == "":
+		e = NewError(RCErrDripPayload, "Part of a chunked message has no correlation ID")
+		return
+	case count == 0 || index >= count:
+		e = Errorf(RCErrDripPayload, "Invalid part %d of a chunked message with %d parts", index, count)
+		return
+	case count > totalSize:
+		// every part has at least one byte, so the size limit also limits the number of parts
+		e = Errorf(RCErrDripPayload, "Chunked message of %d bytes cannot have %d parts", totalSize, count)
+		return
+	case policy.MaxMessageSize > 0 && totalSize > policy.MaxMessageSize:
+		e = Errorf(RCErrDripPayload, "Chunked message of %d bytes is larger than the limit of %d bytes", totalSize, policy.MaxMessageSize)
+		return
+	}
+
+	assembler.lock.Lock()
+	defer assembler.lock.Unlock()
+
+	transfer, inProgress := assembler.transfers[key]
+	if inProgress == false {
+		if policy.MaxPendingSize > 0 && totalSize > policy.MaxPendingSize - assembler.pendingSize {
+			e = Errorf(RCErrDripPayload, "Chunked message of %d bytes would exceed the limit of %d bytes of incomplete messages", totalSize, policy.MaxPendingSize)
+			return
+		}
+		transfer = &chunkTransfer {
+			parts:     make(map[int][]byte),
+			count:     count,
+			totalSize: totalSize,
+		}
+		if policy.Timeout > 0 {
+			transfer.timer = time.AfterFunc(policy.Timeout, func() { assembler.expire(key, transfer) })
+		}
+		assembler.transfers[key] = transfer
+		assembler.pendingSize += totalSize
+	}
+
+	if transfer.count != count || transfer.totalSize != totalSize {
+		assembler.discard(key, transfer)
+		e = Errorf(RCErrDripPayload, "Part %d of chunked message <%s> does not match the earlier parts", index, key)
+		return
+	}
+	if _, duplicate := transfer.parts[index]; duplicate {
+		logging.Log.Debugf("Ignoring a duplicate of part %d of chunked message <%s>", index, key)
+		assembler.settleParts([]amqp.Delivery{delivery}, true)
+		return
+	}
+	transfer.parts[index] = delivery.Body
+	transfer.deliveries = append(transfer.deliveries, delivery)
+	kept = true
+	transfer.received++
+	transfer.size += len(delivery.Body)
+	if index == 0 {
+		transfer.first = delivery
+	}
+	if transfer.size > transfer.totalSize {
+		assembler.discard(key, transfer)
+		e = Errorf(RCErrDripPayload, "Chunked message <%s> is larger than its declared size of %d bytes", key, totalSize)
+		return
+	}
+	if transfer.received < count {
+		return
+	}
+
+	assembler.remove(key, transfer)
+	if transfer.size != transfer.totalSize {
+		assembler.settleParts(transfer.deliveries, false)
+		e = Errorf(RCErrDripPayload, "Chunked message <%s> has %d bytes instead of its declared %d bytes", key, transfer.size, totalSize)
+		return
+	}
+	var body bytes.Buffer
+	body.Grow(transfer.totalSize)
+	for i := 0; i < transfer.count; i++ {
+		body.Write(transfer.parts[i])
+	}
+	message = transfer.first
+	message.Body = body.Bytes()
+	message.Headers = make(amqp.Table, len(transfer.first.Headers))
+	for header, value := range transfer.first.Headers {
+		if header != ChunkIndexHeader && header != ChunkCountHeader && header != ChunkTotalHeader {
+			message.Headers[header] = value
+		}
+	}
+	parts = transfer.deliveries
+	complete = true
+	return
+}
+
+// remove ends a transfer; the assembler's lock must be held.
+func (assembler *chunkAssembler) remove(key string, transfer *chunkTransfer) {
+	if transfer.timer != nil {
+		transfer.timer.Stop()
+	}
+	if assembler.transfers[key] == transfer {
+		delete(assembler.transfers, key)
+		assembler.pendingSize -= transfer.totalSize
+	}
+	return
+}
+
+// expire drops a transfer that did not complete in time.
+func (assembler *chunkAssembler) expire(key string, transfer *chunkTransfer) {
+	assembler.lock.Lock()
+	defer assembler.lock.Unlock()
+	if assembler.transfers[key] != transfer {
+		return
+	}
+	logging.Log.Warningf("Chunked message <%s> timed out with %d of %d parts received", key, transfer.received, transfer.count)
+	assembler.discard(key, transfer)
+	return
+}
+
+// discard ends a transfer that will not be completed, and gives up its parts; the assembler's lock must be held.
+func (assembler *chunkAssembler) discard(key string, transfer *chunkTransfer) {
+	assembler.remove(key, transfer)
+	assembler.settleParts(transfer.deliveries, false)
+	return
+}
+
+// settleParts passes deliveries that the assembler has finished with to its settle function.
+func (assembler *chunkAssembler) settleParts(deliveries []amqp.Delivery, handled bool) {
+	if assembler.settle != nil {
+		assembler.settle(deliveries, handled)
+	}
+	return
+}
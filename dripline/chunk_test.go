@@ -0,0 +1,124 @@
+/*
+* chunk_test.go
+*
+* Tests of the splitting and reassembly of chunked messages.
+ */
+
+package dripline
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// chunkPart gives a part of a chunked message with the given headers and body.
+func chunkPart(corrId string, index, count, totalSize interface{}, body []byte) (delivery amqp.Delivery) {
+	delivery = amqp.Delivery {
+		CorrelationId: corrId,
+		Headers:       amqp.Table{ChunkIndexHeader: index, ChunkCountHeader: count, ChunkTotalHeader: totalSize},
+		Body:          body,
+	}
+	return
+}
+
+func TestChunkReassembly(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10)
+	publishing := amqp.Publishing{CorrelationId: "corr", Headers: amqp.Table{"extra": "kept"}, Body: body}
+	parts := splitPublishing(publishing, 30)
+	if len(parts) != 4 {
+		t.Fatalf("Body of %d bytes was split into %d parts of 30 bytes", len(body), len(parts))
+	}
+
+	assembler := newChunkAssembler(nil)
+	policy := ServiceDefaults().Chunking
+	for i, order := range []int{2, 0, 3, 0, 1} {
+		part := parts[order]
+		message, _, complete, e := assembler.add(amqp.Delivery{CorrelationId: part.CorrelationId, Headers: part.Headers, Body: part.Body}, policy)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if complete != (i == 4) {
+			t.Fatalf("Message is complete after %d parts: %v", i + 1, complete)
+		}
+		if complete && (bytes.Equal(message.Body, body) == false || message.Headers["extra"] != "kept" || len(message.Headers) != 1) {
+			t.Errorf("Reassembled message has headers %v and body %q", message.Headers, message.Body)
+		}
+	}
+}
+
+func TestChunkHeaderLimits(t *testing.T) {
+	policy := ServiceDefaults().Chunking
+	tests := []struct {
+		name    string
+		part    amqp.Delivery
+	}{
+		{"too many parts for the size", chunkPart("corr", 0, int64(1) << 60, 100, []byte("x"))},
+		{"too many parts for the limit", chunkPart("corr", 0, int64(1) << 60, int64(1) << 60, []byte("x"))},
+		{"count beyond int", chunkPart("corr", 0, uint64(math.MaxUint64), uint64(math.MaxUint64), []byte("x"))},
+		{"negative index", chunkPart("corr", -1, 2, 2, []byte("x"))},
+		{"index beyond count", chunkPart("corr", 2, 2, 2, []byte("x"))},
+		{"no parts", chunkPart("corr", 0, 0, 0, nil)},
+		{"no correlation ID", chunkPart("", 0, 2, 2, []byte("x"))},
+		{"size beyond the limit", chunkPart("corr", 0, 2, policy.MaxMessageSize + 1, []byte("x"))},
+	}
+	for _, test := range tests {
+		assembler := newChunkAssembler(nil)
+		if _, _, complete, e := assembler.add(test.part, policy); e == nil || complete {
+			t.Errorf("Part with %s was accepted", test.name)
+		}
+		if len(assembler.transfers) != 0 || assembler.pendingSize != 0 {
+			t.Errorf("Part with %s left a transfer", test.name)
+		}
+	}
+
+	// the size of the incomplete messages must not overflow
+	assembler := newChunkAssembler(nil)
+	pendingPolicy := ChunkPolicy{MaxPendingSize: 1000}
+	if _, _, _, e := assembler.add(chunkPart("first", 0, 2, 500, []byte("x")), pendingPolicy); e != nil {
+		t.Fatal(e)
+	}
+	if _, _, _, e := assembler.add(chunkPart("corr", 0, 2, math.MaxInt, []byte("x")), pendingPolicy); e == nil {
+		t.Errorf("Part beyond the limit of incomplete messages was accepted")
+	}
+
+	// without limits, a part may claim a huge message, but nothing is allocated for the missing parts
+	assembler = newChunkAssembler(nil)
+	if _, _, complete, e := assembler.add(chunkPart("corr", 5, int64(1) << 60, int64(1) << 60, []byte("x")), ChunkPolicy{}); e != nil || complete {
+		t.Errorf("Part of an unlimited message gave complete %v and error %v", complete, e)
+	}
+}
+
+// TestMemoryChunkHeaderLimits sends parts with a huge part count to a service's queue and to its reply queue;
+// the service must reject them and go on handling requests.
+func TestMemoryChunkHeaderLimits(t *testing.T) {
+	broker, client := newEchoService(t, 0)
+	transport := broker.NewTransport()
+	if e := transport.Dial(""); e != nil {
+		t.Fatal(e)
+	}
+	defer transport.Close()
+
+	part := amqp.Publishing {
+		ContentEncoding: "application/json",
+		CorrelationId:   "huge",
+		Headers:         amqp.Table{ChunkIndexHeader: int64(0), ChunkCountHeader: int64(1) << 60, ChunkTotalHeader: int64(100)},
+		Body:            []byte("{"),
+	}
+	if e := transport.Publish("requests", "echo", true, part); e != nil {
+		t.Fatal(e)
+	}
+	if e := transport.Publish("", client.replyQueueName(), true, part); e != nil {
+		t.Fatal(e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if value, e := Call[float64, float64](ctx, client, "echo", MOGet, 2.5); e != nil || value != 2.5 {
+		t.Errorf("Echo after the invalid parts gave %v and error %v", value, e)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+* codec.go
+*
+* Codecs convert message bodies to and from Go values.  They are registered by MIME type,
+* which is carried in the message's content encoding.
+ */
+
+package dripline
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+// DefaultEncoding is used when a message has to be sent without knowing which encoding the recipient understands.
+const DefaultEncoding = "application/json"
+
+// Codec encodes and decodes message bodies of one MIME type.
+// Decoding into an interface{} or a map[string]interface{} must produce the generic maps, slices, and scalars of the encoding.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var codecLock sync.RWMutex
+var codecs = map[string]Codec {
+	"application/json":    JSONCodec{},
+	"application/msgpack": MsgpackCodec{},
+	"application/cbor":    CBORCodec{},
+}
+
+// RegisterCodec makes a codec available for the given MIME type, replacing any codec already registered for it.
+func RegisterCodec(mimeType string, c Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[mimeType] = c
+	return
+}
+
+// LookupCodec returns the codec registered for a MIME type.
+func LookupCodec(mimeType string) (c Codec, registered bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	c, registered = codecs[mimeType]
+	return
+}
+
+// JSONCodec encodes "application/json" bodies.
+type JSONCodec struct {}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// MsgpackCodec encodes "application/msgpack" bodies.
+//
+// By default bodies are written in the current msgpack spec, which distinguishes text from binary data such as the data of an NDArray:
+// strings of 32 to 255 bytes are written with the str8 type, and byte slices with the bin types.  This is a change to the wire format
+// of every msgpack body: earlier versions of dripline-go wrote both strings and byte slices with the raw types of the original spec,
+// and peers whose msgpack library predates the current spec (msgpack-python before 0.4) cannot read the new types.
+// A deployment with such peers can register a codec with OriginalSpec set:
+//    dripline.RegisterCodec("application/msgpack", dripline.MsgpackCodec{OriginalSpec: true})
+// Byte slices are then written as raw strings, which are read back as text, so NDArrays should be sent to those peers as JSON.
+//
+// Bodies in either spec are read: strings and raw strings are decoded as string, and byte strings as []byte.
+type MsgpackCodec struct {
+	OriginalSpec      bool
+}
+
+// msgpackHandle follows the current msgpack spec
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// msgpackOriginalHandle writes the raw types of the original msgpack spec
+var msgpackOriginalHandle = new(codec.MsgpackHandle)
+
+func (c MsgpackCodec) Marshal(v interface{}) (encoded []byte, e error) {
+	handle := msgpackHandle
+	if c.OriginalSpec {
+		handle = msgpackOriginalHandle
+	}
+	e = codec.NewEncoderBytes(&encoded, handle).Encode(v)
+	return
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+// CBORCodec encodes "application/cbor" bodies.
+// Text and byte strings are kept distinct, decoding as string and []byte respectively.
+type CBORCodec struct {}
+
+var cborHandle = new(codec.CborHandle)
+
+func (CBORCodec) Marshal(v interface{}) (encoded []byte, e error) {
+	e = codec.NewEncoderBytes(&encoded, cborHandle).Encode(v)
+	return
+}
+
+func (CBORCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, cborHandle).Decode(v)
+}
@@ -0,0 +1,48 @@
+/*
+* codec_test.go
+*
+* Tests of the body codecs.
+ */
+
+package dripline
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMsgpackSpec checks the msgpack types that are written, and that bodies in the original spec are still read.
+func TestMsgpackSpec(t *testing.T) {
+	var msgpack MsgpackCodec
+	text := strings.Repeat("t", 40)
+	encoded, e := msgpack.Marshal([]interface{}{text, []byte{1, 2}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	// a fixarray of a str8 and a bin8
+	expected := append(append([]byte{0x92, 0xd9, 40}, text...), 0xc4, 2, 1, 2)
+	if bytes.Equal(encoded, expected) == false {
+		t.Errorf("Encoded body is % x, expected % x", encoded, expected)
+	}
+
+	// the original spec has only raw types, here a raw16 and a fixraw
+	original := append(append([]byte{0x92, 0xda, 0, 40}, text...), 0xa2, 1, 2)
+	encoded, e = MsgpackCodec{OriginalSpec: true}.Marshal([]interface{}{text, []byte{1, 2}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if bytes.Equal(encoded, original) == false {
+		t.Errorf("Body encoded in the original spec is % x, expected % x", encoded, original)
+	}
+	for _, reader := range []MsgpackCodec{{}, {OriginalSpec: true}} {
+		var decoded interface{}
+		if e = reader.Unmarshal(original, &decoded); e != nil {
+			t.Fatal(e)
+		}
+		if reflect.DeepEqual(decoded, []interface{}{text, "\x01\x02"}) == false {
+			t.Errorf("Body in the original msgpack spec is decoded as %#v", decoded)
+		}
+	}
+}
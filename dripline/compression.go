@@ -0,0 +1,177 @@
+/*
+* compression.go
+*
+* Message bodies can be compressed.  A compressed body has the compression in its AMQP content encoding,
+* and the MIME type of the body in its content type.
+*
+* Uncompressed bodies are sent with the MIME type in both properties, because earlier versions of dripline-go
+* read the MIME type from the content encoding; such messages are also accepted without a content type.
+ */
+
+package dripline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/streadway/amqp"
+)
+
+// Content encodings for compressed bodies
+const (
+	CompressionIdentity = "identity"
+	CompressionGzip     = "gzip"
+	CompressionZstd     = "zstd"
+)
+
+// DefaultCompressionThreshold is the size in bytes above which a service compresses message bodies, if compression is enabled.
+const DefaultCompressionThreshold = 64 * 1024
+
+// MaxDecompressedSize limits the size of a decompressed body, to guard against bodies that expand without bound.
+var MaxDecompressedSize = 256 * 1024 * 1024
+
+// Compressor compresses and decompresses message bodies for one content encoding.
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var compressorLock sync.RWMutex
+var compressors = map[string]Compressor {
+	CompressionGzip: GzipCompressor{},
+	CompressionZstd: ZstdCompressor{},
+}
+
+// RegisterCompressor makes a compressor available for the given content encoding, replacing any compressor already registered for it.
+func RegisterCompressor(contentEncoding string, c Compressor) {
+	compressorLock.Lock()
+	defer compressorLock.Unlock()
+	compressors[contentEncoding] = c
+	return
+}
+
+// LookupCompressor returns the compressor registered for a content encoding.
+func LookupCompressor(contentEncoding string) (c Compressor, registered bool) {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	c, registered = compressors[contentEncoding]
+	return
+}
+
+// GzipCompressor handles "gzip" bodies.
+type GzipCompressor struct {}
+
+func (GzipCompressor) Compress(data []byte) (compressed []byte, e error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, e = writer.Write(data); e != nil {
+		return
+	}
+	if e = writer.Close(); e != nil {
+		return
+	}
+	compressed = buffer.Bytes()
+	return
+}
+
+func (GzipCompressor) Decompress(data []byte) (decompressed []byte, e error) {
+	reader, e := gzip.NewReader(bytes.NewReader(data))
+	if e != nil {
+		return
+	}
+	defer reader.Close()
+	limit := MaxDecompressedSize
+	if decompressed, e = io.ReadAll(io.LimitReader(reader, int64(limit) + 1)); e != nil {
+		decompressed = nil
+		return
+	}
+	if len(decompressed) > limit {
+		decompressed = nil
+		e = fmt.Errorf("Decompressed body is larger than %d bytes", limit)
+	}
+	return
+}
+
+// ZstdCompressor handles "zstd" bodies.
+type ZstdCompressor struct {}
+
+// The zstd encoder is safe for concurrent use, and is shared
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+func (ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+// Decompress reads the body through a decoder of its own, so that MaxDecompressedSize applies as it is when the body arrives.
+func (ZstdCompressor) Decompress(data []byte) (decompressed []byte, e error) {
+	limit := MaxDecompressedSize
+	reader, e := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)))
+	if e != nil {
+		return
+	}
+	defer reader.Close()
+	if decompressed, e = io.ReadAll(io.LimitReader(reader, int64(limit) + 1)); e != nil {
+		decompressed = nil
+		return
+	}
+	if len(decompressed) > limit {
+		decompressed = nil
+		e = fmt.Errorf("Decompressed body is larger than %d bytes", limit)
+	}
+	return
+}
+
+// compressPublishing moves the MIME type of a publishing's body into its content type,
+// and compresses the body if it is at least threshold bytes long and compression makes it smaller.
+// An empty compression, or "identity", leaves the body uncompressed.
+func compressPublishing(publishing *amqp.Publishing, compression string, threshold int) (e error) {
+	publishing.ContentType = publishing.ContentEncoding
+	if compression == "" || compression == CompressionIdentity || len(publishing.Body) < threshold {
+		return
+	}
+	compressor, registered := LookupCompressor(compression)
+	if registered == false {
+		e = fmt.Errorf("Compression <%s> is not registered", compression)
+		return
+	}
+	compressed, e := compressor.Compress(publishing.Body)
+	if e != nil {
+		e = fmt.Errorf("Unable to compress the message body with %s: %v", compression, e)
+		return
+	}
+	if len(compressed) >= len(publishing.Body) {
+		return
+	}
+	publishing.Body = compressed
+	publishing.ContentEncoding = compression
+	return
+}
+
+// decompressDelivery returns the uncompressed body of a delivery and its MIME type.
+func decompressDelivery(amqpMessage *amqp.Delivery) (body []byte, mimeType string, e error) {
+	body = amqpMessage.Body
+	mimeType = amqpMessage.ContentType
+	contentEncoding := amqpMessage.ContentEncoding
+	if mimeType == "" {
+		// the MIME type is in the content encoding, and the body is not compressed
+		mimeType = contentEncoding
+		return
+	}
+	if contentEncoding == "" || contentEncoding == CompressionIdentity || contentEncoding == mimeType {
+		return
+	}
+
+	compressor, registered := LookupCompressor(contentEncoding)
+	if registered == false {
+		e = Errorf(RCErrDripNoEnc, "Message content encoding is not understood: %s", contentEncoding)
+		return
+	}
+	if body, e = compressor.Decompress(amqpMessage.Body); e != nil {
+		e = Errorf(RCErrDripDecFail, "Unable to decompress %s-encoded message: %v", contentEncoding, e)
+	}
+	return
+}
@@ -0,0 +1,37 @@
+/*
+* compression_test.go
+*
+* Tests of the body compressors.
+ */
+
+package dripline
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecompressLimit(t *testing.T) {
+	defer func(limit int) { MaxDecompressedSize = limit }(MaxDecompressedSize)
+
+	body := bytes.Repeat([]byte("dripline"), 1024)
+	for _, contentEncoding := range []string{CompressionGzip, CompressionZstd} {
+		compressor, _ := LookupCompressor(contentEncoding)
+		compressed, e := compressor.Compress(body)
+		if e != nil {
+			t.Fatalf("%s: %v", contentEncoding, e)
+		}
+
+		MaxDecompressedSize = len(body)
+		decompressed, e := compressor.Decompress(compressed)
+		if e != nil || bytes.Equal(decompressed, body) == false {
+			t.Errorf("%s: body at the size limit was not decompressed: %v", contentEncoding, e)
+		}
+
+		// the limit is read on every call, not when the compressor is set up
+		MaxDecompressedSize = len(body) - 1
+		if decompressed, e = compressor.Decompress(compressed); e == nil || decompressed != nil {
+			t.Errorf("%s: body over the size limit was decompressed to %d bytes", contentEncoding, len(decompressed))
+		}
+	}
+}
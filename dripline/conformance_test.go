@@ -0,0 +1,263 @@
+/*
+* conformance_test.go
+*
+* Checks of the golden wire messages in testdata/conformance/vectors.json, which is written by generate.py.
+* Every vector is decoded with DecodeAndHandle and re-encoded in the wire format it arrived in;
+* the re-encoded properties, headers, and body must match the vector, and no element may be lost or changed.
+ */
+
+package dripline
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+const conformancePath = "testdata/conformance/vectors.json"
+
+// conformanceVector is a golden wire message: JSON bodies are given as text, and binary bodies in base64.
+// v2 messages have headers; an empty content type is not set.
+type conformanceVector struct {
+	Name          string `json:"name"`
+	Properties    struct {
+		ContentEncoding string `json:"content_encoding"`
+		ContentType     string `json:"content_type"`
+		RoutingKey      string `json:"routing_key"`
+		CorrelationId   string `json:"correlation_id"`
+		ReplyTo         string `json:"reply_to"`
+		Headers         map[string]interface{} `json:"headers"`
+	} `json:"properties"`
+	Body          string `json:"body"`
+	BodyBase64    string `json:"body_base64"`
+}
+
+// readConformanceVectors reads the conformance corpus.
+func readConformanceVectors(t *testing.T) (vectors []conformanceVector) {
+	t.Helper()
+	contents, e := os.ReadFile(conformancePath)
+	if e != nil {
+		t.Fatalf("Unable to read the conformance corpus: %v", e)
+	}
+	if e = json.Unmarshal(contents, &vectors); e != nil {
+		t.Fatalf("Unable to parse the conformance corpus: %v", e)
+	}
+	return
+}
+
+func TestConformance(t *testing.T) {
+	for _, vector := range readConformanceVectors(t) {
+		vector := vector
+		t.Run(vector.Name, func(t *testing.T) {
+			if e := checkVector(vector); e != nil {
+				t.Error(e)
+			}
+		})
+	}
+}
+
+func checkVector(vector conformanceVector) (e error) {
+	body := []byte(vector.Body)
+	if vector.BodyBase64 != "" {
+		if body, e = base64.StdEncoding.DecodeString(vector.BodyBase64); e != nil {
+			return
+		}
+	}
+	delivery := amqp.Delivery {
+		ContentEncoding: vector.Properties.ContentEncoding,
+		ContentType:     vector.Properties.ContentType,
+		RoutingKey:      vector.Properties.RoutingKey,
+		CorrelationId:   vector.Properties.CorrelationId,
+		ReplyTo:         vector.Properties.ReplyTo,
+		Body:            body,
+	}
+	version := WireV1
+	if vector.Properties.Headers != nil {
+		delivery.Headers = headerTable(vector.Properties.Headers)
+		version = WireV2
+	}
+
+	var received encodable
+	e = DecodeAndHandle(&delivery,
+		func(request Request) { received = &request },
+		func(reply Reply) { received = &reply },
+		func(alert Alert) { received = &alert },
+		func(info Info) { received = &info })
+	if e != nil {
+		return
+	}
+	message := received.base()
+	if (*message).WireVersion != version {
+		e = fmt.Errorf("Message was read in wire format v%d, expected v%d", (*message).WireVersion, version)
+		return
+	}
+	fields := []struct {
+		name, got, expected string
+	}{
+		{"Target", (*message).Target, vector.Properties.RoutingKey},
+		{"CorrId", (*message).CorrId, vector.Properties.CorrelationId},
+		{"ReplyTo", (*message).ReplyTo, vector.Properties.ReplyTo},
+		{"Encoding", (*message).Encoding, vector.Properties.ContentEncoding},
+	}
+	if e = compareProperties(fields); e != nil {
+		return
+	}
+
+	// Re-encode the message the way the service sends it
+	publishing, e := encodePublishing(received, version)
+	if e == nil {
+		e = compressPublishing(&publishing, "", 0)
+	}
+	if e != nil {
+		e = fmt.Errorf("Unable to re-encode: %v", e)
+		return
+	}
+	properties := []struct {
+		name, got, expected string
+	}{
+		{"content_encoding", publishing.ContentEncoding, vector.Properties.ContentEncoding},
+		{"correlation_id", publishing.CorrelationId, vector.Properties.CorrelationId},
+		{"reply_to", publishing.ReplyTo, vector.Properties.ReplyTo},
+	}
+	if vector.Properties.ContentType != "" {
+		properties = append(properties, struct{ name, got, expected string }{"content_type", publishing.ContentType, vector.Properties.ContentType})
+	}
+	if e = compareProperties(properties); e != nil {
+		return
+	}
+	if e = compareElements("Header", delivery.Headers, publishing.Headers); e != nil {
+		return
+	}
+
+	// Compare the bodies element by element; a null element is the same as a missing one
+	bodyCodec, _ := LookupCodec(vector.Properties.ContentEncoding)
+	if version == WireV2 {
+		var payload, roundTrip interface{}
+		if e = bodyCodec.Unmarshal(body, &payload); e != nil {
+			return
+		}
+		if e = bodyCodec.Unmarshal(publishing.Body, &roundTrip); e != nil {
+			return
+		}
+		if reflect.DeepEqual(canonical(payload), canonical(roundTrip)) == false {
+			e = fmt.Errorf("Payload is %v after re-encoding, expected %v", canonical(roundTrip), canonical(payload))
+		}
+		return
+	}
+	var original, roundTrip map[string]interface{}
+	if e = bodyCodec.Unmarshal(body, &original); e != nil {
+		return
+	}
+	if e = bodyCodec.Unmarshal(publishing.Body, &roundTrip); e != nil {
+		return
+	}
+	e = compareElements("Element", original, roundTrip)
+	return
+}
+
+// compareProperties reports the first property that does not have its expected value.
+func compareProperties(properties []struct{ name, got, expected string }) (e error) {
+	for _, property := range properties {
+		if property.got != property.expected {
+			e = fmt.Errorf("%s is <%s>, expected <%s>", property.name, property.got, property.expected)
+			return
+		}
+	}
+	return
+}
+
+// compareElements reports the first element that differs between the original and the re-encoded elements;
+// a null element is the same as a missing one.
+func compareElements[M ~map[string]interface{}](kind string, original, roundTrip M) (e error) {
+	for _, elements := range []M{original, roundTrip} {
+		for element := range elements {
+			expected, got := canonical(map[string]interface{}(original)[element]), canonical(map[string]interface{}(roundTrip)[element])
+			if reflect.DeepEqual(expected, got) == false {
+				e = fmt.Errorf("%s <%s> is %v after re-encoding, expected %v", kind, element, got, expected)
+				return
+			}
+		}
+	}
+	return
+}
+
+// headerTable converts headers read from JSON into the types that an AMQP header table holds:
+// integers are int64, and objects are tables.
+func headerTable(headers map[string]interface{}) (table amqp.Table) {
+	table = make(amqp.Table, len(headers))
+	for name, value := range headers {
+		table[name] = headerTableValue(value)
+	}
+	return
+}
+
+func headerTableValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case float64:
+		if val == math.Trunc(val) {
+			return int64(val)
+		}
+		return val
+	case map[string]interface{}:
+		return headerTable(val)
+	case []interface{}:
+		converted := make([]interface{}, len(val))
+		for i, elem := range val {
+			converted[i] = headerTableValue(elem)
+		}
+		return converted
+	default:
+		return value
+	}
+}
+
+// canonical converts a decoded element into a form that compares equal across codecs:
+// maps have string keys, byte strings are strings, and numbers are float64.
+func canonical(element interface{}) interface{} {
+	switch val := element.(type) {
+	case nil:
+		return nil
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case bool:
+		return val
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(val))
+		for key, elem := range val {
+			converted[key] = canonical(elem)
+		}
+		return converted
+	case amqp.Table:
+		return canonical(map[string]interface{}(val))
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(val))
+		for key, elem := range val {
+			converted[fmt.Sprint(canonical(key))] = canonical(elem)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(val))
+		for i, elem := range val {
+			converted[i] = canonical(elem)
+		}
+		return converted
+	}
+	value := reflect.ValueOf(element)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	}
+	return element
+}
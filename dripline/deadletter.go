@@ -0,0 +1,179 @@
+/*
+* deadletter.go
+*
+* Dead-lettering of messages that a service cannot handle, so that they can be inspected afterwards.
+*
+* With a DeadLetterPolicy, the service queue is declared with a dead-letter exchange, and the broker moves messages that are rejected
+* without being requeued (see AckManual) to that exchange.  Messages that cannot be decoded are published to the dead-letter exchange
+* by the service itself, in either acknowledgement mode, with the decode error in the x-decode-error header.
+*
+* Dead letters carry RabbitMQ's x-first-death-reason, x-first-death-queue, and x-first-death-exchange headers;
+* the service uses the reason "undecodable" for the messages that it dead-letters.
+ */
+
+package dripline
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// Headers of dead-lettered messages
+const (
+	DecodeErrorHeader   = "x-decode-error"
+	DeathReasonHeader   = "x-first-death-reason"
+	DeathQueueHeader    = "x-first-death-queue"
+	DeathExchangeHeader = "x-first-death-exchange"
+	deathHeader         = "x-death"
+)
+
+// Reasons for dead-lettering a message; the broker may also use others, such as "expired" and "maxlen"
+const (
+	DeadLetterRejected    = "rejected"
+	DeadLetterUndecodable = "undecodable"
+)
+
+// DeadLetterPolicy configures the dead-lettering of a service's messages.
+type DeadLetterPolicy struct {
+	// Exchange is the dead-letter exchange; dead-lettering is disabled if it is empty
+	Exchange          string
+	// Queue is a durable queue, bound to Exchange for all routing keys, that collects the dead letters; none is declared if it is empty
+	Queue             string
+}
+
+// DeadLetter is a message taken from a dead-letter queue.
+// Acknowledge it with Delivery.Ack to remove it from the queue; pass &Delivery to DecodeAndHandle to decode it.
+type DeadLetter struct {
+	Delivery          amqp.Delivery
+	// Reason is why the message was first dead-lettered, such as "rejected" or "undecodable"
+	Reason            string
+	// Queue and Exchange are where the message was first dead-lettered from
+	Queue             string
+	Exchange          string
+	// Count is the number of times the message has been dead-lettered from Queue, if the broker reports it
+	Count             int
+	// DecodeError is the error from decoding an undecodable message
+	DecodeError       string
+}
+
+// declareDeadLetters declares the dead-letter exchange and queue of a policy.
+func declareDeadLetters(transport Transport, policy DeadLetterPolicy) (e error) {
+	if policy.Exchange == "" {
+		return
+	}
+	if e = transport.ExchangeDeclare(policy.Exchange); e != nil {
+		e = fmt.Errorf("Unable to declare the dead-letter exchange (%s): %v", policy.Exchange, e)
+		return
+	}
+	if policy.Queue == "" {
+		return
+	}
+	if _, e = transport.QueueDeclare(policy.Queue, QueueOptions{Durable: true}); e != nil {
+		e = fmt.Errorf("Unable to declare the dead-letter queue <%s>: %v", policy.Queue, e)
+		return
+	}
+	if e = transport.QueueBind(policy.Queue, "#", policy.Exchange); e != nil {
+		e = fmt.Errorf("Unable to bind the dead-letter queue <%s>: %v", policy.Queue, e)
+	}
+	return
+}
+
+// ConsumeDeadLetters declares the exchange and queue of a dead-letter policy on a connected transport, and delivers the messages in the queue.
+// The channel is closed when the transport is closed.  Messages that are not acknowledged return to the queue when the transport closes.
+func ConsumeDeadLetters(transport Transport, policy DeadLetterPolicy) (deadLetters <-chan DeadLetter, e error) {
+	if policy.Exchange == "" || policy.Queue == "" {
+		e = fmt.Errorf("Dead-letter policy needs an exchange and a queue")
+		return
+	}
+	if e = declareDeadLetters(transport, policy); e != nil {
+		return
+	}
+	deliveries, e := transport.Consume(policy.Queue)
+	if e != nil {
+		e = fmt.Errorf("Unable to consume from the dead-letter queue <%s>: %v", policy.Queue, e)
+		return
+	}
+
+	out := make(chan DeadLetter)
+	go func() {
+		defer close(out)
+		for delivery := range deliveries {
+			out <- readDeadLetter(delivery)
+		}
+	}()
+	deadLetters = out
+	return
+}
+
+// readDeadLetter takes the details of a dead letter from its headers.
+func readDeadLetter(delivery amqp.Delivery) (deadLetter DeadLetter) {
+	deadLetter.Delivery = delivery
+	deadLetter.Reason, _ = delivery.Headers[DeathReasonHeader].(string)
+	deadLetter.Queue, _ = delivery.Headers[DeathQueueHeader].(string)
+	deadLetter.Exchange, _ = delivery.Headers[DeathExchangeHeader].(string)
+	deadLetter.DecodeError, _ = delivery.Headers[DecodeErrorHeader].(string)
+	if deaths, hasDeaths := delivery.Headers[deathHeader].([]interface{}); hasDeaths {
+		for _, deathIfc := range deaths {
+			death, isTable := deathIfc.(amqp.Table)
+			if isTable == false || death["queue"] != deadLetter.Queue {
+				continue
+			}
+			if count, convErr := ConvertToMsgCode(death["count"]); convErr == nil {
+				deadLetter.Count = int(count)
+			}
+			break
+		}
+	}
+	return
+}
+
+// deadLetterUndecodable publishes an undecodable message to the dead-letter exchange, with the decode error in a header,
+// and then acknowledges its deliveries.  Without a dead-letter exchange, or if the publish fails, the deliveries are rejected.
+func (service *AmqpService) deadLetterUndecodable(amqpMessage amqp.Delivery, parts []amqp.Delivery, decodeErr error) {
+	if service.DeadLetter.Exchange == "" {
+		service.settleDeliveries(parts, false)
+		return
+	}
+
+	publishing := deliveryPublishing(amqpMessage)
+	publishing.Headers = make(amqp.Table, len(amqpMessage.Headers) + 4)
+	for header, value := range amqpMessage.Headers {
+		publishing.Headers[header] = value
+	}
+	publishing.Headers[DecodeErrorHeader] = decodeErr.Error()
+	publishing.Headers[DeathReasonHeader] = DeadLetterUndecodable
+	publishing.Headers[DeathQueueHeader] = service.Receiver.QueueName
+	publishing.Headers[DeathExchangeHeader] = amqpMessage.Exchange
+	if publishErr := service.Transport.Publish(service.DeadLetter.Exchange, amqpMessage.RoutingKey, true, publishing); publishErr != nil {
+		logging.Log.Errorf("Unable to dead-letter an undecodable message:\n\t%v", publishErr)
+		service.settleDeliveries(parts, false)
+		return
+	}
+	logging.Log.Infof("Undecodable message was sent to dead-letter exchange <%s>", service.DeadLetter.Exchange)
+	service.settleDeliveries(parts, true)
+	return
+}
+
+// deliveryPublishing gives the properties and body of a delivery as a publishing; the headers are shared with the delivery.
+func deliveryPublishing(delivery amqp.Delivery) (publishing amqp.Publishing) {
+	publishing = amqp.Publishing {
+		Headers:         delivery.Headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Expiration:      delivery.Expiration,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		UserId:          delivery.UserId,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+	return
+}
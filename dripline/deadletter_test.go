@@ -0,0 +1,108 @@
+/*
+* deadletter_test.go
+*
+* Tests of the dead-lettering of rejected and undecodable messages, over the memory broker.
+ */
+
+package dripline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var testDeadLetterPolicy = DeadLetterPolicy{Exchange: "dead-letters", Queue: "dead"}
+
+// newDeadLetterListener starts a service that listens for alerts and dead-letters to testDeadLetterPolicy,
+// and returns it with a transport to publish from and the dead letters.
+func newDeadLetterListener(t *testing.T, ackMode AckMode) (listener *AmqpService, transport Transport, deadLetters <-chan DeadLetter) {
+	broker := NewMemoryBroker()
+	listener = newTestService(t, broker, "listener", func(service *AmqpService) {
+		service.AckMode = ackMode
+		service.MaxRedeliveries = 1
+		service.DeadLetter = testDeadLetterPolicy
+	})
+	if e := listener.SubscribeToAlerts("sensor.#"); e != nil {
+		t.Fatal(e)
+	}
+	transport = broker.NewTransport()
+	if e := transport.Dial(""); e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { transport.Close() })
+	deadLetters, e := ConsumeDeadLetters(transport, testDeadLetterPolicy)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return
+}
+
+// receiveDeadLetter waits for the next dead letter, and acknowledges it.
+func receiveDeadLetter(t *testing.T, deadLetters <-chan DeadLetter) (deadLetter DeadLetter) {
+	t.Helper()
+	select {
+	case deadLetter = <-deadLetters:
+		deadLetter.Delivery.Ack(false)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No dead letter was received")
+	}
+	return
+}
+
+// checkDeadLetter checks where a dead letter came from and why.
+func checkDeadLetter(t *testing.T, deadLetter DeadLetter, reason string, count int) {
+	t.Helper()
+	if deadLetter.Reason != reason || deadLetter.Queue != "listener" || deadLetter.Exchange != "alerts" || deadLetter.Count != count {
+		t.Errorf("Dead letter has reason <%s>, queue <%s>, exchange <%s>, and count %d; expected <%s>, <listener>, <alerts>, and %d",
+			deadLetter.Reason, deadLetter.Queue, deadLetter.Exchange, deadLetter.Count, reason, count)
+	}
+	return
+}
+
+func TestMemoryDeadLetterRejected(t *testing.T) {
+	listener, transport, deadLetters := newDeadLetterListener(t, AckManual)
+
+	// an alert rejected by its handler
+	publishAlert(t, transport, "sensor.a", "rejected")
+	select {
+	case alert := <-listener.Receiver.AlertChan:
+		if e := alert.Reject(false); e != nil {
+			t.Fatal(e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Alert was not received")
+	}
+	deadLetter := receiveDeadLetter(t, deadLetters)
+	checkDeadLetter(t, deadLetter, DeadLetterRejected, 1)
+	var payload interface{}
+	if e := DecodeAndHandle(&deadLetter.Delivery, nil, nil, func(alert Alert) { payload = alert.Payload }, nil); e != nil || payload != "rejected" {
+		t.Errorf("Dead letter decodes to payload %#v, error %v", payload, e)
+	}
+
+	// an alert that is requeued by its handler until the service gives up on it
+	publishAlert(t, transport, "sensor.b", "requeued")
+	handleAlerts(listener, func(alert Alert, delivered int) {
+		alert.Nack(true)
+	})
+	checkDeadLetter(t, receiveDeadLetter(t, deadLetters), DeadLetterRejected, 1)
+}
+
+func TestMemoryDeadLetterUndecodable(t *testing.T) {
+	for name, ackMode := range map[string]AckMode{"on receipt": AckOnReceipt, "manual": AckManual} {
+		t.Run(name, func(t *testing.T) {
+			_, transport, deadLetters := newDeadLetterListener(t, ackMode)
+			publishing := amqp.Publishing{ContentEncoding: "application/json", Headers: amqp.Table{"origin": "test"}, Body: []byte("{not json")}
+			if e := transport.Publish("alerts", "sensor.a", true, publishing); e != nil {
+				t.Fatal(e)
+			}
+
+			deadLetter := receiveDeadLetter(t, deadLetters)
+			checkDeadLetter(t, deadLetter, DeadLetterUndecodable, 0)
+			if deadLetter.DecodeError == "" || string(deadLetter.Delivery.Body) != "{not json" || deadLetter.Delivery.Headers["origin"] != "test" {
+				t.Errorf("Dead letter has decode error %q, body %q, and headers %v", deadLetter.DecodeError, deadLetter.Delivery.Body, deadLetter.Delivery.Headers)
+			}
+		})
+	}
+}
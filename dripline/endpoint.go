@@ -0,0 +1,356 @@
+/*
+* endpoint.go
+*
+* Endpoints are request handlers registered with an AmqpService under a name.
+* The service subscribes to the name, dispatches incoming requests by their MsgOp, and sends the reply.
+*
+* A request for <name>.<more words> is also handled by the endpoint <name>, with the remaining words as the specifier,
+* so a single endpoint can expose a tree of attributes and methods addressed by dotted specifiers (see TreeEndpoint).
+ */
+
+package dripline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// Endpoint handles the requests that are sent to the name under which it was registered.
+// Each method returns the payload for the Reply, or an error that is converted to the Reply's RetCode and ReturnMessage.
+// Return a DriplineError to choose the RetCode and payload; any other error is reported with RCErrUnhandled.
+type Endpoint interface {
+	OnGet(request Request) (interface{}, error)
+	OnSet(request Request) (interface{}, error)
+	OnCmd(request Request) (interface{}, error)
+	OnConfig(request Request) (interface{}, error)
+}
+
+// ErrMethodNotSupported is returned by an endpoint for an operation it does not implement; it is reported with RCErrDripMethod.
+var ErrMethodNotSupported = NewError(RCErrDripMethod, "Method is not supported by this endpoint")
+
+// errEndpointPanicked is wrapped by the error that callEndpoint returns when an endpoint panics
+var errEndpointPanicked = errors.New("Endpoint panicked")
+
+// EndpointBase rejects every operation with ErrMethodNotSupported.
+// Embed it in an endpoint type to implement only the operations that the endpoint supports.
+type EndpointBase struct {}
+
+func (EndpointBase) OnGet(request Request) (interface{}, error) {
+	return nil, ErrMethodNotSupported
+}
+
+func (EndpointBase) OnSet(request Request) (interface{}, error) {
+	return nil, ErrMethodNotSupported
+}
+
+func (EndpointBase) OnCmd(request Request) (interface{}, error) {
+	return nil, ErrMethodNotSupported
+}
+
+func (EndpointBase) OnConfig(request Request) (interface{}, error) {
+	return nil, ErrMethodNotSupported
+}
+
+// endpointRequest is a request on its way to the endpoint that will handle it.
+type endpointRequest struct {
+	endpoint          Endpoint
+	request           Request
+}
+
+// AddEndpoint registers an endpoint with the service and subscribes the service's queue to requests sent to the endpoint's name,
+// and to the routing keys that extend the name with a specifier.
+// Endpoints can be added before or after the service is started.
+func (service *AmqpService) AddEndpoint(name string, endpoint Endpoint) (e error) {
+	if service.Receiver.QueueName == "" {
+		e = fmt.Errorf("Service needs a queue to receive requests for endpoints")
+		return
+	}
+
+	service.endpointLock.Lock()
+	if _, exists := service.endpoints[name]; exists {
+		service.endpointLock.Unlock()
+		e = fmt.Errorf("Endpoint <%s> is already registered", name)
+		return
+	}
+	service.endpoints[name] = endpoint
+	service.endpointLock.Unlock()
+
+	// The subscriptions are recorded before they are bound, so that a connection that is set up meanwhile restores them;
+	// the service is only marked as connected while the subscriptions are locked
+	exchange := service.Sender.RequestExchangeName
+	routingKeys := []string{name, name + ".#"}
+	var added []string
+	service.subscriptionLock.Lock()
+	for _, routingKey := range routingKeys {
+		if service.recordSubscription(exchange, routingKey) {
+			added = append(added, routingKey)
+		}
+	}
+	connected := service.IsConnected()
+	service.subscriptionLock.Unlock()
+	if connected == false {
+		// The bindings will be made when the service connects
+		logging.Log.Debugf("Endpoint <%s> will be subscribed when the service connects", name)
+		return
+	}
+
+	for _, routingKey := range routingKeys {
+		if e = service.Transport.QueueBind(service.Receiver.QueueName, routingKey, exchange); e != nil {
+			break
+		}
+	}
+	if e == nil {
+		e = service.beginConsuming()
+	}
+	if e != nil {
+		// Bindings that were made stay with the queue until it is deleted, but are no longer restored
+		service.removeSubscriptions(exchange, added)
+		service.endpointLock.Lock()
+		delete(service.endpoints, name)
+		service.endpointLock.Unlock()
+		return
+	}
+	logging.Log.Debugf("Endpoint <%s> registered", name)
+	return
+}
+
+// resolveEndpoint looks up the endpoint that should handle a request.
+// The routing key and specifier are joined into one dotted path, and the endpoint with the longest name that is a prefix of the path is chosen;
+// the request's Specifier is then set to the rest of the path.
+func (service *AmqpService) resolveEndpoint(request *Request) (endpoint Endpoint, found bool) {
+	path := request.Target
+	if request.Specifier != "" {
+		path += "." + request.Specifier
+	}
+	words := strings.Split(path, ".")
+
+	service.endpointLock.Lock()
+	defer service.endpointLock.Unlock()
+	for n := len(words); n > 0; n-- {
+		if endpoint, found = service.endpoints[strings.Join(words[:n], ".")]; found {
+			request.Specifier = strings.Join(words[n:], ".")
+			return
+		}
+	}
+	return
+}
+
+// runEndpoints handles the requests for registered endpoints one at a time until the channel is closed.
+func (service *AmqpService) runEndpoints() {
+	for toHandle := range service.endpointRequests {
+		service.handleEndpointRequest(toHandle.endpoint, toHandle.request)
+	}
+	return
+}
+
+// handleEndpointRequest calls the endpoint method for the request's MsgOp and sends the reply.
+// In the AckManual mode the request is then acknowledged, or, if the endpoint panicked, requeued.
+func (service *AmqpService) handleEndpointRequest(endpoint Endpoint, request Request) {
+	payload, handleErr := callEndpoint(endpoint, request)
+
+	if service.AckMode == AckManual && errors.Is(handleErr, errEndpointPanicked) {
+		// the request is delivered again, up to MaxRedeliveries times, rather than answered
+		logSettleError(request.Nack(true))
+		return
+	}
+	defer func() { logSettleError(request.Ack()) }()
+
+	if request.ReplyTo == "" {
+		if handleErr != nil {
+			logging.Log.Warningf("Request to endpoint <%s> failed, and no reply was requested:\n\t%v", request.Target, handleErr)
+		}
+		return
+	}
+
+	reply := PrepareReplyToRequest(request, RCSuccess, "", service.senderInfo)
+	if handleErr != nil {
+		reply.RetCode = RetCodeOf(handleErr)
+		reply.ReturnMessage = handleErr.Error()
+		var dripErr *DriplineError
+		if errors.As(handleErr, &dripErr) {
+			reply.Payload = dripErr.Payload
+		}
+	} else {
+		reply.Payload = payload
+	}
+	if sendErr := service.SendReply(reply); sendErr != nil {
+		logging.Log.Errorf("Unable to send the reply from endpoint <%s>:\n\t%v", request.Target, sendErr)
+	}
+	return
+}
+
+// callEndpoint dispatches a request by its MsgOp; a panic in the endpoint is returned as an error.
+func callEndpoint(endpoint Endpoint, request Request) (payload interface{}, e error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logging.Log.Errorf("Endpoint <%s> panicked while handling a request: %v", request.Target, recovered)
+			e = fmt.Errorf("%w: %v", errEndpointPanicked, recovered)
+		}
+	}()
+
+	switch request.MsgOp {
+	case MOGet:
+		payload, e = endpoint.OnGet(request)
+	case MOSet:
+		payload, e = endpoint.OnSet(request)
+	case MOCommand:
+		payload, e = endpoint.OnCmd(request)
+	case MOConfig:
+		payload, e = endpoint.OnConfig(request)
+	default:
+		e = fmt.Errorf("%w: operation %d", ErrMethodNotSupported, request.MsgOp)
+	}
+	return
+}
+
+
+//*********************
+//*** Tree Endpoint ***
+//*********************
+
+// TreeEndpoint exposes attributes and methods addressed by dotted specifiers, such as "ch1.voltage".
+// Get and set requests go to attributes, and command requests go to methods.
+// A specifier that starts with the name of a child endpoint is passed to the child with that name removed.
+type TreeEndpoint struct {
+	lock              sync.Mutex
+	attributes        map[string]treeAttribute
+	methods           map[string]func(Request) (interface{}, error)
+	children          map[string]Endpoint
+}
+
+type treeAttribute struct {
+	get               func() (interface{}, error)
+	set               func(value interface{}) error
+}
+
+// NewTreeEndpoint creates a TreeEndpoint with no attributes or methods.
+func NewTreeEndpoint() (tree *TreeEndpoint) {
+	tree = &TreeEndpoint {
+		attributes: make(map[string]treeAttribute),
+		methods:    make(map[string]func(Request) (interface{}, error)),
+		children:   make(map[string]Endpoint),
+	}
+	return
+}
+
+// AddAttribute adds an attribute; either get or set may be nil to make it write-only or read-only.
+// The empty specifier addresses requests sent to the endpoint itself.
+func (tree *TreeEndpoint) AddAttribute(specifier string, get func() (interface{}, error), set func(value interface{}) error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.attributes[specifier] = treeAttribute{get: get, set: set}
+	return
+}
+
+// AddMethod adds a method, which is called for command requests with the given specifier.
+func (tree *TreeEndpoint) AddMethod(specifier string, method func(request Request) (interface{}, error)) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.methods[specifier] = method
+	return
+}
+
+// AddChild adds an endpoint that handles all specifiers beginning with name.
+func (tree *TreeEndpoint) AddChild(name string, child Endpoint) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.children[name] = child
+	return
+}
+
+func (tree *TreeEndpoint) OnGet(request Request) (interface{}, error) {
+	attribute, found, child := tree.lookupAttribute(&request)
+	if child != nil {
+		return child.OnGet(request)
+	}
+	if found == false || attribute.get == nil {
+		return nil, Errorf(RCErrDripMethod, "No readable attribute <%s>", request.Specifier)
+	}
+	return attribute.get()
+}
+
+func (tree *TreeEndpoint) OnSet(request Request) (interface{}, error) {
+	attribute, found, child := tree.lookupAttribute(&request)
+	if child != nil {
+		return child.OnSet(request)
+	}
+	if found == false || attribute.set == nil {
+		return nil, Errorf(RCErrDripMethod, "No writable attribute <%s>", request.Specifier)
+	}
+	if e := attribute.set(setValue(request.Payload)); e != nil {
+		return nil, e
+	}
+	if attribute.get == nil {
+		return nil, nil
+	}
+	return attribute.get()
+}
+
+func (tree *TreeEndpoint) OnCmd(request Request) (interface{}, error) {
+	tree.lock.Lock()
+	method, found := tree.methods[request.Specifier]
+	tree.lock.Unlock()
+	if found {
+		return method(request)
+	}
+	if child := tree.lookupChild(&request); child != nil {
+		return child.OnCmd(request)
+	}
+	return nil, Errorf(RCErrDripMethod, "No method <%s>", request.Specifier)
+}
+
+func (tree *TreeEndpoint) OnConfig(request Request) (interface{}, error) {
+	if child := tree.lookupChild(&request); child != nil {
+		return child.OnConfig(request)
+	}
+	return nil, ErrMethodNotSupported
+}
+
+// lookupAttribute finds the attribute for a request's specifier, or else the child endpoint that should handle it.
+func (tree *TreeEndpoint) lookupAttribute(request *Request) (attribute treeAttribute, found bool, child Endpoint) {
+	tree.lock.Lock()
+	attribute, found = tree.attributes[request.Specifier]
+	tree.lock.Unlock()
+	if found == false {
+		child = tree.lookupChild(request)
+	}
+	return
+}
+
+// lookupChild finds the child endpoint with the longest name that is a prefix of the specifier, and removes the name from the specifier.
+func (tree *TreeEndpoint) lookupChild(request *Request) (child Endpoint) {
+	words := strings.Split(request.Specifier, ".")
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	for n := len(words); n > 0; n-- {
+		var found bool
+		if child, found = tree.children[strings.Join(words[:n], ".")]; found {
+			request.Specifier = strings.Join(words[n:], ".")
+			return
+		}
+	}
+	return nil
+}
+
+// setValue extracts the new value from the payload of a set request.
+// Following the Python dripline convention, the payload may be a map holding the value as the first element of "values";
+// a map with a "value" element and a bare value are also accepted.
+func setValue(payload interface{}) interface{} {
+	payloadMap, isMap := stringMap(payload)
+	if isMap == false {
+		return payload
+	}
+	if values, hasValues := payloadMap["values"]; hasValues {
+		if valueList, isList := values.([]interface{}); isList && len(valueList) > 0 {
+			return valueList[0]
+		}
+	}
+	if value, hasValue := payloadMap["value"]; hasValue {
+		return value
+	}
+	return payload
+}
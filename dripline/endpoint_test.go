@@ -0,0 +1,321 @@
+/*
+* endpoint_test.go
+*
+* Tests of endpoints, and of how the service dispatches requests to them, over the memory broker.
+ */
+
+package dripline
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// failingEndpoint fails each operation in a different way; its first command panics.
+type failingEndpoint struct {
+	EndpointBase
+	commands          atomic.Int32
+}
+
+func (endpoint *failingEndpoint) OnGet(request Request) (interface{}, error) {
+	return nil, &DriplineError{RetCode: RCErrHWNoResp, Message: "Instrument did not respond", Payload: map[string]interface{}{"channel": "ch1"}}
+}
+
+func (endpoint *failingEndpoint) OnSet(request Request) (interface{}, error) {
+	return nil, errors.New("Set failed")
+}
+
+func (endpoint *failingEndpoint) OnCmd(request Request) (interface{}, error) {
+	if endpoint.commands.Add(1) == 1 {
+		panic("first command")
+	}
+	return "recovered", nil
+}
+
+// publishCounter counts the messages published through a transport.
+type publishCounter struct {
+	Transport
+	published         atomic.Int32
+}
+
+func (transport *publishCounter) Publish(exchange, routingKey string, mandatory bool, msg amqp.Publishing) error {
+	transport.published.Add(1)
+	return transport.Transport.Publish(exchange, routingKey, mandatory, msg)
+}
+
+// newFailingService starts a service with a failingEndpoint named "fail", and returns the endpoint and a client.
+func newFailingService(t *testing.T, ackMode AckMode) (endpoint *failingEndpoint, server, client *AmqpService) {
+	broker := NewMemoryBroker()
+	server = newTestService(t, broker, "server", func(service *AmqpService) {
+		service.AckMode = ackMode
+		service.MaxRedeliveries = 1
+		service.Transport = &publishCounter{Transport: broker.NewTransport()}
+	})
+	endpoint = &failingEndpoint{}
+	if e := server.AddEndpoint("fail", endpoint); e != nil {
+		t.Fatal(e)
+	}
+	client = newTestService(t, broker, "")
+	return
+}
+
+// requestReply sends a request to target and waits for the reply.
+func requestReply(t *testing.T, client *AmqpService, target string, op MsgCodeT) (reply Reply) {
+	t.Helper()
+	reply = sendAndWait(t, client, PrepareRequest(target, "application/json", op, SenderInfo{}))
+	return
+}
+
+// sendAndWait sends a request and waits for the reply.
+func sendAndWait(t *testing.T, client *AmqpService, request Request) (reply Reply) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	reply, e := client.SendRequestContext(ctx, request)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return
+}
+
+func TestMemoryEndpointErrors(t *testing.T) {
+	_, _, client := newFailingService(t, AckOnReceipt)
+
+	tests := []struct {
+		name      string
+		op        MsgCodeT
+		retCode   MsgCodeT
+		message   string
+		payload   interface{}
+	}{
+		{"DriplineError", MOGet, RCErrHWNoResp, "Instrument did not respond", map[string]interface{}{"channel": "ch1"}},
+		{"plain error", MOSet, RCErrUnhandled, "Set failed", nil},
+		{"unimplemented operation", MOConfig, RCErrDripMethod, ErrMethodNotSupported.Error(), nil},
+		{"unknown operation", MsgCodeT(42), RCErrDripMethod, ErrMethodNotSupported.Error() + ": operation 42", nil},
+	}
+	for _, test := range tests {
+		reply := requestReply(t, client, "fail", test.op)
+		if reply.RetCode != test.retCode || reply.ReturnMessage != test.message || reflect.DeepEqual(reply.Payload, test.payload) == false {
+			t.Errorf("%s: reply has RetCode %d, message %q, and payload %#v; expected %d, %q, and %#v",
+				test.name, reply.RetCode, reply.ReturnMessage, reply.Payload, test.retCode, test.message, test.payload)
+		}
+	}
+}
+
+// TestMemoryEndpointPanic checks that a request whose endpoint panics is answered when it was acknowledged on receipt,
+// and delivered again when it is acknowledged manually.
+func TestMemoryEndpointPanic(t *testing.T) {
+	endpoint, _, client := newFailingService(t, AckOnReceipt)
+	reply := requestReply(t, client, "fail", MOCommand)
+	if reply.RetCode != RCErrUnhandled || strings.Contains(reply.ReturnMessage, "first command") == false {
+		t.Errorf("Reply from a panicking endpoint has RetCode %d and message %q", reply.RetCode, reply.ReturnMessage)
+	}
+	if calls := endpoint.commands.Load(); calls != 1 {
+		t.Errorf("Endpoint handled the command %d times, expected once", calls)
+	}
+
+	endpoint, _, client = newFailingService(t, AckManual)
+	reply = requestReply(t, client, "fail", MOCommand)
+	if reply.RetCode != RCSuccess || reply.Payload != "recovered" {
+		t.Errorf("Reply from the redelivered command has RetCode %d and payload %#v", reply.RetCode, reply.Payload)
+	}
+	if calls := endpoint.commands.Load(); calls != 2 {
+		t.Errorf("Endpoint handled the command %d times, expected twice", calls)
+	}
+}
+
+// TestMemoryEndpointNoReplyTo checks that no reply is sent to a request without a reply queue.
+func TestMemoryEndpointNoReplyTo(t *testing.T) {
+	_, server, client := newFailingService(t, AckOnReceipt)
+	toSend := PrepareRequest("fail", "application/json", MOSet, SenderInfo{})
+	publishing, e := encodePublishing(&toSend, WireV1)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = client.Transport.Publish("requests", "fail", true, publishing); e != nil {
+		t.Fatal(e)
+	}
+
+	// the endpoint handles requests in order, so the first has been handled when the reply to the second arrives
+	requestReply(t, client, "fail", MOSet)
+	if published := server.Transport.(*publishCounter).published.Load(); published != 1 {
+		t.Errorf("Service published %d replies, expected only the one to the request with a reply queue", published)
+	}
+}
+
+// bindFailure fails to bind the given routing key.
+type bindFailure struct {
+	Transport
+	routingKey        string
+}
+
+func (transport bindFailure) QueueBind(queue, routingKey, exchange string) error {
+	if routingKey == transport.routingKey {
+		return errors.New("Binding failed")
+	}
+	return transport.Transport.QueueBind(queue, routingKey, exchange)
+}
+
+// TestMemoryAddEndpointFailure checks that an endpoint whose subscriptions fail is not registered, and leaves no subscriptions behind.
+func TestMemoryAddEndpointFailure(t *testing.T) {
+	broker := NewMemoryBroker()
+	server := newTestService(t, broker, "server", func(service *AmqpService) {
+		service.Transport = bindFailure{Transport: broker.NewTransport(), routingKey: "fail.#"}
+	})
+	if e := server.AddEndpoint("fail", &failingEndpoint{}); e == nil {
+		t.Fatal("Endpoint was added although its subscription failed")
+	}
+	if _, found := server.resolveEndpoint(&Request{Message: Message{Target: "fail"}}); found {
+		t.Errorf("Endpoint is registered although its subscription failed")
+	}
+	server.subscriptionLock.Lock()
+	defer server.subscriptionLock.Unlock()
+	if len(server.subscriptions) != 0 {
+		t.Errorf("Subscriptions of the failed endpoint are recorded: %v", server.subscriptions)
+	}
+}
+
+// namedEndpoint is an endpoint that can be told apart from others by its name.
+type namedEndpoint struct {
+	EndpointBase
+	name              string
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	service := ServiceDefaults()
+	for _, name := range []string{"psu", "psu.ch1", "pump"} {
+		service.endpoints[name] = namedEndpoint{name: name}
+	}
+	tests := []struct {
+		target    string
+		specifier string
+		endpoint  string
+		rest      string
+	}{
+		{"psu", "", "psu", ""},
+		{"psu", "ch1.voltage", "psu.ch1", "voltage"},
+		{"psu.ch1.voltage", "", "psu.ch1", "voltage"},
+		{"psu.ch1", "voltage", "psu.ch1", "voltage"},
+		{"psu.ch2.voltage", "", "psu", "ch2.voltage"},
+		{"psu", "ch2", "psu", "ch2"},
+		{"pump.speed", "", "pump", "speed"},
+		{"psu2", "", "", ""},
+		{"valve", "psu", "", ""},
+	}
+	for _, test := range tests {
+		request := Request{Message: Message{Target: test.target}, Specifier: test.specifier}
+		endpoint, found := service.resolveEndpoint(&request)
+		if test.endpoint == "" {
+			if found {
+				t.Errorf("<%s> with specifier %q resolved to endpoint %v, expected none", test.target, test.specifier, endpoint)
+			}
+			continue
+		}
+		if found == false || endpoint.(namedEndpoint).name != test.endpoint || request.Specifier != test.rest {
+			t.Errorf("<%s> with specifier %q resolved to endpoint %v with specifier %q; expected <%s> with %q",
+				test.target, test.specifier, endpoint, request.Specifier, test.endpoint, test.rest)
+		}
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	tests := []struct {
+		payload   interface{}
+		value     interface{}
+	}{
+		{map[string]interface{}{"values": []interface{}{5., 6.}}, 5.},
+		{map[interface{}]interface{}{"values": []interface{}{int64(5)}}, int64(5)},
+		{map[string]interface{}{"value": 7.}, 7.},
+		{map[string]interface{}{"values": []interface{}{}, "value": 7.}, 7.},
+		{map[string]interface{}{"values": 8., "value": 7.}, 7.},
+		{map[string]interface{}{"values": []interface{}{5.}, "value": 7.}, 5.},
+		{map[string]interface{}{"other": 1.}, map[string]interface{}{"other": 1.}},
+		{9., 9.},
+		{"off", "off"},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		if value := setValue(test.payload); reflect.DeepEqual(value, test.value) == false {
+			t.Errorf("Set payload %#v gave value %#v, expected %#v", test.payload, value, test.value)
+		}
+	}
+}
+
+// newTreeService starts a service with a TreeEndpoint named "psu", and returns a client.  The tree has
+//    ch1.voltage: an attribute that can be read and written
+//    serial:      a read-only attribute
+//    output:      a write-only attribute
+//    reset:       a method that returns the value last written to output
+//    ch2:         a child endpoint with a voltage attribute and an off method
+func newTreeService(t *testing.T) (client *AmqpService) {
+	var lock sync.Mutex
+	voltage, output := interface{}(0.), interface{}(nil)
+	tree := NewTreeEndpoint()
+	tree.AddAttribute("ch1.voltage",
+		func() (interface{}, error) { lock.Lock(); defer lock.Unlock(); return voltage, nil },
+		func(value interface{}) error { lock.Lock(); defer lock.Unlock(); voltage = value; return nil })
+	tree.AddAttribute("serial", func() (interface{}, error) { return "A1", nil }, nil)
+	tree.AddAttribute("output", nil, func(value interface{}) error { lock.Lock(); defer lock.Unlock(); output = value; return nil })
+	tree.AddMethod("reset", func(request Request) (interface{}, error) { lock.Lock(); defer lock.Unlock(); return output, nil })
+	child := NewTreeEndpoint()
+	child.AddAttribute("voltage", func() (interface{}, error) { return 2.5, nil }, nil)
+	child.AddMethod("off", func(request Request) (interface{}, error) { return "ch2 off", nil })
+	tree.AddChild("ch2", child)
+
+	broker := NewMemoryBroker()
+	server := newTestService(t, broker, "server")
+	if e := server.AddEndpoint("psu", tree); e != nil {
+		t.Fatal(e)
+	}
+	client = newTestService(t, broker, "")
+	return
+}
+
+func TestMemoryTreeEndpoint(t *testing.T) {
+	client := newTreeService(t)
+	tests := []struct {
+		name      string
+		target    string
+		specifier string
+		op        MsgCodeT
+		payload   interface{}
+		retCode   MsgCodeT
+		reply     interface{}
+	}{
+		{"set with values", "psu", "ch1.voltage", MOSet, map[string]interface{}{"values": []interface{}{5.}}, RCSuccess, 5.},
+		{"get by routing key", "psu.ch1.voltage", "", MOGet, nil, RCSuccess, 5.},
+		{"set with value", "psu.ch1", "voltage", MOSet, map[string]interface{}{"value": 6.}, RCSuccess, 6.},
+		{"set with a bare value", "psu.ch1.voltage", "", MOSet, 7., RCSuccess, 7.},
+		{"get by specifier", "psu", "ch1.voltage", MOGet, nil, RCSuccess, 7.},
+		{"get read-only", "psu", "serial", MOGet, nil, RCSuccess, "A1"},
+		{"set read-only", "psu", "serial", MOSet, "B2", RCErrDripMethod, nil},
+		{"set write-only", "psu.output", "", MOSet, true, RCSuccess, nil},
+		{"get write-only", "psu.output", "", MOGet, nil, RCErrDripMethod, nil},
+		{"method", "psu.reset", "", MOCommand, nil, RCSuccess, true},
+		{"attribute as method", "psu", "serial", MOCommand, nil, RCErrDripMethod, nil},
+		{"child attribute", "psu.ch2.voltage", "", MOGet, nil, RCSuccess, 2.5},
+		{"child method", "psu", "ch2.off", MOCommand, nil, RCSuccess, "ch2 off"},
+		{"unknown child attribute", "psu.ch2", "current", MOGet, nil, RCErrDripMethod, nil},
+		{"unknown attribute", "psu", "ch3.voltage", MOGet, nil, RCErrDripMethod, nil},
+		{"endpoint itself", "psu", "", MOGet, nil, RCErrDripMethod, nil},
+		{"config", "psu", "ch2.voltage", MOConfig, nil, RCErrDripMethod, nil},
+	}
+	for _, test := range tests {
+		request := PrepareRequest(test.target, "application/json", test.op, SenderInfo{})
+		request.Specifier = test.specifier
+		request.Payload = test.payload
+		reply := sendAndWait(t, client, request)
+		if reply.RetCode != test.retCode || reflect.DeepEqual(reply.Payload, test.reply) == false {
+			t.Errorf("%s: reply has RetCode %d (%s) and payload %#v; expected %d and %#v",
+				test.name, reply.RetCode, reply.ReturnMessage, reply.Payload, test.retCode, test.reply)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+* errors.go
+*
+* Go errors that carry dripline return codes, and the registry of return codes with their names and descriptions
+ */
+
+package dripline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DriplineError is an error with a dripline return code, and optionally a payload to send along with it in a Reply.
+type DriplineError struct {
+	RetCode       MsgCodeT
+	Message       string
+	Payload       interface{}
+}
+
+// NewError creates a DriplineError with the given return code and message.
+func NewError(retCode MsgCodeT, message string) (e *DriplineError) {
+	e = &DriplineError {
+		RetCode: retCode,
+		Message: message,
+	}
+	return
+}
+
+// Errorf creates a DriplineError with the given return code and a formatted message.
+func Errorf(retCode MsgCodeT, format string, args ...interface{}) (e *DriplineError) {
+	e = NewError(retCode, fmt.Sprintf(format, args...))
+	return
+}
+
+// Error returns the message, or the description of the return code if there is no message.
+func (e *DriplineError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	if info, registered := LookupRetCode(e.RetCode); registered {
+		return info.Description
+	}
+	return fmt.Sprintf("Dripline error with return code %d", e.RetCode)
+}
+
+// Is reports whether target is a DriplineError with the same return code,
+// so that, for instance, errors.Is(e, ErrDripTimeout) is true for any error with RCErrDripTimeout.
+func (e *DriplineError) Is(target error) bool {
+	targetErr, isDripline := target.(*DriplineError)
+	return isDripline && targetErr.RetCode == e.RetCode
+}
+
+// Sentinel errors for the standard return codes, for use with errors.Is
+var (
+	ErrWarnNoAction   = &DriplineError{RetCode: RCWarnNoAction}
+	ErrAMQP           = &DriplineError{RetCode: RCErrAMQP}
+	ErrAMQPConn       = &DriplineError{RetCode: RCErrAMQPConn}
+	ErrAMQPRK         = &DriplineError{RetCode: RCErrAMQPRK}
+	ErrHW             = &DriplineError{RetCode: RCErrHW}
+	ErrHWConn         = &DriplineError{RetCode: RCErrHWConn}
+	ErrHWNoResp       = &DriplineError{RetCode: RCErrHWNoResp}
+	ErrDrip           = &DriplineError{RetCode: RCErrDrip}
+	ErrDripNoEnc      = &DriplineError{RetCode: RCErrDripNoEnc}
+	ErrDripDecFail    = &DriplineError{RetCode: RCErrDripDecFail}
+	ErrDripPayload    = &DriplineError{RetCode: RCErrDripPayload}
+	ErrDripValue      = &DriplineError{RetCode: RCErrDripValue}
+	ErrDripTimeout    = &DriplineError{RetCode: RCErrDripTimeout}
+	ErrDripMethod     = &DriplineError{RetCode: RCErrDripMethod}
+	ErrDripAccDen     = &DriplineError{RetCode: RCErrDripAccDen}
+	ErrDripInvKey     = &DriplineError{RetCode: RCErrDripInvKey}
+	ErrDB             = &DriplineError{RetCode: RCErrDB}
+	ErrUnhandled      = &DriplineError{RetCode: RCErrUnhandled}
+)
+
+// DecodeError describes a message element that is missing or malformed.
+// It matches ErrDripDecFail with errors.Is, and is reported with RCErrDripDecFail.
+type DecodeError struct {
+	Field         string
+	Reason        string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Unable to decode message element <%s>: %s", e.Field, e.Reason)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return ErrDripDecFail
+}
+
+// RetCodeOf returns the return code that reports an error: RCSuccess for nil, the code of a DriplineError, and RCErrUnhandled otherwise.
+func RetCodeOf(e error) MsgCodeT {
+	if e == nil {
+		return RCSuccess
+	}
+	var dripErr *DriplineError
+	if errors.As(e, &dripErr) {
+		return dripErr.RetCode
+	}
+	return RCErrUnhandled
+}
+
+// Err returns nil for a successful Reply, and otherwise a DriplineError with the reply's return code, message, and payload.
+func (reply *Reply) Err() error {
+	if (*reply).RetCode == RCSuccess {
+		return nil
+	}
+	return &DriplineError {
+		RetCode: (*reply).RetCode,
+		Message: (*reply).ReturnMessage,
+		Payload: (*reply).Payload,
+	}
+}
+
+
+//****************************
+//*** Return-Code Registry ***
+//****************************
+
+// RetCodeInfo describes a return code.
+type RetCodeInfo struct {
+	Code          MsgCodeT
+	Name          string
+	Description   string
+}
+
+// The names of the standard return codes are those of the Python and C++ dripline implementations,
+// so that names received from them can be looked up with LookupRetCodeName.
+var retCodeLock sync.RWMutex
+var retCodes = map[MsgCodeT]RetCodeInfo {
+	RCSuccess:        {RCSuccess, "success", "Success"},
+	RCWarnNoAction:   {RCWarnNoAction, "warning_no_action_taken", "No action taken"},
+	RCErrAMQP:        {RCErrAMQP, "amqp_error", "Generic AMQP error"},
+	RCErrAMQPConn:    {RCErrAMQPConn, "amqp_error_broker_connection", "Unable to connect to the AMQP broker"},
+	RCErrAMQPRK:      {RCErrAMQPRK, "amqp_error_routingkey_notfound", "No queue is bound to the routing key"},
+	RCErrHW:          {RCErrHW, "resource_error", "Generic resource (hardware) error"},
+	RCErrHWConn:      {RCErrHWConn, "resource_error_connection", "Unable to connect to the resource"},
+	RCErrHWNoResp:    {RCErrHWNoResp, "resource_error_no_response", "No response from the resource"},
+	RCErrDrip:        {RCErrDrip, "service_error", "Generic service error"},
+	RCErrDripNoEnc:   {RCErrDripNoEnc, "service_error_no_encoding", "Message encoding is not supported"},
+	RCErrDripDecFail: {RCErrDripDecFail, "service_error_decoding_fail", "Unable to decode the message"},
+	RCErrDripPayload: {RCErrDripPayload, "service_error_bad_payload", "Payload is invalid"},
+	RCErrDripValue:   {RCErrDripValue, "service_error_invalid_value", "Value is invalid"},
+	RCErrDripTimeout: {RCErrDripTimeout, "service_error_timeout", "Timeout while waiting for a reply"},
+	RCErrDripMethod:  {RCErrDripMethod, "service_error_invalid_method", "Method is not supported"},
+	RCErrDripAccDen:  {RCErrDripAccDen, "service_error_access_denied", "Access denied"},
+	RCErrDripInvKey:  {RCErrDripInvKey, "service_error_invalid_key", "Lockout key is invalid"},
+	RCErrDB:          {RCErrDB, "database_error", "Generic database error"},
+	RCErrUnhandled:   {RCErrUnhandled, "unhandled_exception", "Unhandled error"},
+}
+
+// RegisterRetCode adds an application-defined return code to the registry.
+// A code or name that is already registered cannot be registered again.
+func RegisterRetCode(code MsgCodeT, name, description string) (e error) {
+	retCodeLock.Lock()
+	defer retCodeLock.Unlock()
+	if existing, registered := retCodes[code]; registered {
+		e = fmt.Errorf("Return code %d is already registered as <%s>", code, existing.Name)
+		return
+	}
+	for _, existing := range retCodes {
+		if existing.Name == name {
+			e = fmt.Errorf("Return code name <%s> is already registered for code %d", name, existing.Code)
+			return
+		}
+	}
+	retCodes[code] = RetCodeInfo{code, name, description}
+	return
+}
+
+// LookupRetCode returns the registered information about a return code.
+func LookupRetCode(code MsgCodeT) (info RetCodeInfo, registered bool) {
+	retCodeLock.RLock()
+	defer retCodeLock.RUnlock()
+	info, registered = retCodes[code]
+	return
+}
+
+// LookupRetCodeName returns the registered information about the return code with the given name.
+func LookupRetCodeName(name string) (info RetCodeInfo, registered bool) {
+	retCodeLock.RLock()
+	defer retCodeLock.RUnlock()
+	for _, info = range retCodes {
+		if info.Name == name {
+			registered = true
+			return
+		}
+	}
+	info = RetCodeInfo{}
+	return
+}
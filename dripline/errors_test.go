@@ -0,0 +1,85 @@
+/*
+* errors_test.go
+*
+* Tests of the dripline error values and the return-code registry.
+ */
+
+package dripline
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestErrorsMatchRetCodes(t *testing.T) {
+	e := Errorf(RCErrDripValue, "Voltage %v is out of range", 99.)
+	if errors.Is(e, ErrDripValue) == false || errors.Is(e, ErrDripPayload) {
+		t.Errorf("Error with RetCode %d matches the wrong sentinels", e.RetCode)
+	}
+	if code := RetCodeOf(e); code != RCErrDripValue {
+		t.Errorf("RetCodeOf gives %d, expected %d", code, RCErrDripValue)
+	}
+	if code := RetCodeOf(errors.New("plain")); code != RCErrUnhandled {
+		t.Errorf("RetCodeOf a plain error gives %d, expected %d", code, RCErrUnhandled)
+	}
+
+	reply := PrepareReply("client", "application/json", "corr", RCErrDripTimeout, "Too slow", SenderInfo{})
+	if replyErr := reply.Err(); errors.Is(replyErr, ErrDripTimeout) == false || replyErr.Error() != "Too slow" {
+		t.Errorf("Reply.Err gives %v", replyErr)
+	}
+	reply.RetCode = RCSuccess
+	if replyErr := reply.Err(); replyErr != nil {
+		t.Errorf("Reply.Err of a successful reply gives %v", replyErr)
+	}
+}
+
+// TestRetCodeNames checks that the registry has the return-code names used by the conformance vectors,
+// which are those of the other dripline implementations.
+func TestRetCodeNames(t *testing.T) {
+	checked := 0
+	for _, vector := range readConformanceVectors(t) {
+		if strings.HasPrefix(vector.Name, "reply_") == false || strings.HasSuffix(vector.Name, "_json") == false || strings.Contains(vector.Name, "unknown") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(vector.Name, "reply_"), "_json")
+		var body struct {
+			RetCode MsgCodeT `json:"retcode"`
+		}
+		if e := json.Unmarshal([]byte(vector.Body), &body); e != nil {
+			t.Fatalf("Vector <%s>: %v", vector.Name, e)
+		}
+		info, registered := LookupRetCodeName(name)
+		if registered == false || info.Code != body.RetCode {
+			t.Errorf("Return code name <%s> should be registered for code %d, got %+v", name, body.RetCode, info)
+		}
+		checked++
+	}
+	standard := 0
+	for code := range retCodes {
+		if code <= RCErrUnhandled {
+			standard++
+		}
+	}
+	if checked != standard {
+		t.Errorf("Checked %d return-code names, but %d standard codes are registered", checked, standard)
+	}
+}
+
+func TestRegisterRetCode(t *testing.T) {
+	if e := RegisterRetCode(RCErrDripValue, "my_error", ""); e == nil {
+		t.Errorf("A standard return code should not be registered again")
+	}
+	if e := RegisterRetCode(5001, "service_error", ""); e == nil {
+		t.Errorf("A standard return-code name should not be registered again")
+	}
+	if _, registered := LookupRetCode(5002); registered == false {
+		if e := RegisterRetCode(5002, "test_pump_stalled", "The pump stalled"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if info, registered := LookupRetCode(5002); registered == false || info.Name != "test_pump_stalled" {
+		t.Errorf("Registered return code is not found: %+v", info)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+* lockout.go
+*
+* Exclusive lockout of a service, compatible with the Python dripline lockout workflow.
+*
+* A client sends a command to <queue>.lock and receives a key; while the service is locked,
+* set and command requests must carry that key as their lockout_key, or they are refused with RCErrDripAccDen.
+* The lock is released with a command to <queue>.unlock, and its state can be checked with <queue>.is_locked.
+ */
+
+package dripline
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pborman/uuid"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// Lockout commands, appended to the service's queue name to form the routing keys
+const (
+	LockCommand     = "lock"
+	UnlockCommand   = "unlock"
+	IsLockedCommand = "is_locked"
+)
+
+// lockoutOptions are the optional payload elements of the lockout commands.
+type lockoutOptions struct {
+	Timeout           float64 `codec:"timeout"`
+	Force             bool    `codec:"force"`
+}
+
+// lockoutEndpoint handles one of the lockout commands.
+type lockoutEndpoint struct {
+	EndpointBase
+	service           *AmqpService
+	command           string
+}
+
+// EnableLockout registers the lockout commands as endpoints of the service, under the service's queue name.
+// Locks expire after LockTimeout if it is positive, unless the lock request gives its own "timeout" in seconds.
+func (service *AmqpService) EnableLockout() (e error) {
+	for _, command := range []string{LockCommand, UnlockCommand, IsLockedCommand} {
+		endpoint := &lockoutEndpoint{service: service, command: command}
+		if e = service.AddEndpoint(service.lockoutTarget(command), endpoint); e != nil {
+			return
+		}
+	}
+	service.lockoutLock.Lock()
+	service.lockoutEnabled = true
+	service.lockoutLock.Unlock()
+	return
+}
+
+// IsLocked reports whether the service is currently locked.
+func (service *AmqpService) IsLocked() bool {
+	service.lockoutLock.Lock()
+	defer service.lockoutLock.Unlock()
+	service.expireLockout()
+	return service.lockoutKey != ""
+}
+
+func (service *AmqpService) lockoutTarget(command string) string {
+	return service.Receiver.QueueName + "." + command
+}
+
+// expireLockout releases an expired lock; the lockout lock must be held.
+func (service *AmqpService) expireLockout() {
+	if service.lockoutKey != "" && !service.lockoutExpiry.IsZero() && time.Now().After(service.lockoutExpiry) {
+		logging.Log.Info("Service lock has expired")
+		service.lockoutKey = ""
+		service.lockoutExpiry = time.Time{}
+	}
+	return
+}
+
+// checkLockout refuses set and command requests that do not carry the key of the current lock.
+// The endpoint is the one that will handle the request, if any.
+func (service *AmqpService) checkLockout(request Request, endpoint Endpoint) (e error) {
+	if request.MsgOp != MOSet && request.MsgOp != MOCommand {
+		return
+	}
+	if _, isLockout := endpoint.(*lockoutEndpoint); isLockout {
+		// the lockout commands check the key themselves
+		return
+	}
+	service.lockoutLock.Lock()
+	defer service.lockoutLock.Unlock()
+	if service.lockoutEnabled == false {
+		return
+	}
+	service.expireLockout()
+	if service.lockoutKey != "" && request.LockoutKey != service.lockoutKey {
+		e = NewError(RCErrDripAccDen, "Service is locked, and the request does not have the lockout key")
+	}
+	return
+}
+
+func (endpoint *lockoutEndpoint) OnCmd(request Request) (payload interface{}, e error) {
+	var options lockoutOptions
+	if request.Payload != nil {
+		if e = request.DecodePayload(&options); e != nil {
+			return
+		}
+	}
+
+	service := endpoint.service
+	service.lockoutLock.Lock()
+	defer service.lockoutLock.Unlock()
+	service.expireLockout()
+
+	switch endpoint.command {
+	case LockCommand:
+		if service.lockoutKey != "" && request.LockoutKey != service.lockoutKey {
+			e = NewError(RCErrDripAccDen, "Service is already locked")
+			return
+		}
+		if service.lockoutKey == "" {
+			service.lockoutKey = uuid.New()
+			logging.Log.Infof("Service locked by %s@%s", request.SenderInfo.Username, request.SenderInfo.Hostname)
+		}
+		timeout := service.LockTimeout
+		if options.Timeout > 0 {
+			timeout = time.Duration(options.Timeout * float64(time.Second))
+		}
+		service.lockoutExpiry = time.Time{}
+		if timeout > 0 {
+			service.lockoutExpiry = time.Now().Add(timeout)
+		}
+		payload = map[string]interface{}{"key": service.lockoutKey}
+	case UnlockCommand:
+		if service.lockoutKey == "" {
+			e = NewError(RCWarnNoAction, "Service is not locked")
+			return
+		}
+		if request.LockoutKey != service.lockoutKey && options.Force == false {
+			e = NewError(RCErrDripAccDen, "Request does not have the lockout key")
+			return
+		}
+		service.lockoutKey = ""
+		service.lockoutExpiry = time.Time{}
+		logging.Log.Infof("Service unlocked by %s@%s", request.SenderInfo.Username, request.SenderInfo.Hostname)
+	case IsLockedCommand:
+		payload = map[string]interface{}{"is_locked": service.lockoutKey != ""}
+	default:
+		e = fmt.Errorf("Unknown lockout command <%s>", endpoint.command)
+	}
+	return
+}
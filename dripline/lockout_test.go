@@ -0,0 +1,165 @@
+/*
+* lockout_test.go
+*
+* Tests of the lockout of a service, over the memory broker.
+ */
+
+package dripline
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// settableEndpoint answers every operation with the request's payload.
+type settableEndpoint struct {}
+
+func (settableEndpoint) OnGet(request Request) (interface{}, error) {
+	return request.Payload, nil
+}
+
+func (settableEndpoint) OnSet(request Request) (interface{}, error) {
+	return request.Payload, nil
+}
+
+func (settableEndpoint) OnCmd(request Request) (interface{}, error) {
+	return request.Payload, nil
+}
+
+func (settableEndpoint) OnConfig(request Request) (interface{}, error) {
+	return request.Payload, nil
+}
+
+// newLockableService starts a service named "psu" with lockout enabled and a settableEndpoint named "voltage", and returns it with a client.
+func newLockableService(t *testing.T, lockTimeout time.Duration) (server, client *AmqpService) {
+	broker := NewMemoryBroker()
+	server = newTestService(t, broker, "psu", func(service *AmqpService) {
+		service.LockTimeout = lockTimeout
+	})
+	if e := server.EnableLockout(); e != nil {
+		t.Fatal(e)
+	}
+	if e := server.AddEndpoint("voltage", settableEndpoint{}); e != nil {
+		t.Fatal(e)
+	}
+	client = newTestService(t, broker, "")
+	return
+}
+
+// sendWithKey sends a request with the given lockout key and payload, and waits for the reply.
+func sendWithKey(t *testing.T, client *AmqpService, target string, op MsgCodeT, key string, payload interface{}) (reply Reply) {
+	t.Helper()
+	request := PrepareRequest(target, "application/json", op, SenderInfo{})
+	request.LockoutKey = key
+	request.Payload = payload
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	reply, e := client.SendRequestContext(ctx, request)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return
+}
+
+// lockService locks the service, and returns the key.
+func lockService(t *testing.T, client *AmqpService, payload interface{}) (key string) {
+	t.Helper()
+	reply := sendWithKey(t, client, "psu." + LockCommand, MOCommand, "", payload)
+	var locked struct {
+		Key       string  `codec:"key"`
+	}
+	if e := reply.Err(); e != nil {
+		t.Fatal(e)
+	}
+	if e := reply.DecodePayload(&locked); e != nil || locked.Key == "" {
+		t.Fatalf("Lock reply has payload %#v, error %v", reply.Payload, e)
+	}
+	key = locked.Key
+	return
+}
+
+// checkRetCode checks the return code of a reply.
+func checkRetCode(t *testing.T, what string, reply Reply, retCode MsgCodeT) {
+	t.Helper()
+	if reply.RetCode != retCode {
+		t.Errorf("%s gave RetCode %d (%s), expected %d", what, reply.RetCode, reply.ReturnMessage, retCode)
+	}
+	return
+}
+
+// checkLocked checks the answer to is_locked.
+func checkLocked(t *testing.T, client *AmqpService, locked bool) {
+	t.Helper()
+	reply := sendWithKey(t, client, "psu." + IsLockedCommand, MOCommand, "", nil)
+	var state struct {
+		IsLocked  bool    `codec:"is_locked"`
+	}
+	if e := reply.DecodePayload(&state); e != nil || state.IsLocked != locked {
+		t.Errorf("is_locked gave payload %#v, error %v; expected %v", reply.Payload, e, locked)
+	}
+	return
+}
+
+func TestMemoryLockout(t *testing.T) {
+	server, client := newLockableService(t, 0)
+	checkLocked(t, client, false)
+	key := lockService(t, client, nil)
+	checkLocked(t, client, true)
+	if server.IsLocked() == false {
+		t.Errorf("Service is not locked after the lock command")
+	}
+
+	checkRetCode(t, "Set without the key", sendWithKey(t, client, "voltage", MOSet, "", 5.), RCErrDripAccDen)
+	checkRetCode(t, "Command without the key", sendWithKey(t, client, "voltage", MOCommand, "", nil), RCErrDripAccDen)
+	checkRetCode(t, "Set with the wrong key", sendWithKey(t, client, "voltage", MOSet, "wrong", 5.), RCErrDripAccDen)
+	checkRetCode(t, "Lock without the key", sendWithKey(t, client, "psu." + LockCommand, MOCommand, "", nil), RCErrDripAccDen)
+	if reply := sendWithKey(t, client, "voltage", MOSet, key, 5.); reply.RetCode != RCSuccess || reply.Payload != 5. {
+		t.Errorf("Set with the key gave RetCode %d and payload %#v", reply.RetCode, reply.Payload)
+	}
+	checkRetCode(t, "Command with the key", sendWithKey(t, client, "voltage", MOCommand, key, nil), RCSuccess)
+	checkRetCode(t, "Get without the key", sendWithKey(t, client, "voltage", MOGet, "", nil), RCSuccess)
+
+	checkRetCode(t, "Unlock with the wrong key", sendWithKey(t, client, "psu." + UnlockCommand, MOCommand, "wrong", nil), RCErrDripAccDen)
+	checkLocked(t, client, true)
+	checkRetCode(t, "Unlock with the key", sendWithKey(t, client, "psu." + UnlockCommand, MOCommand, key, nil), RCSuccess)
+	checkLocked(t, client, false)
+	checkRetCode(t, "Set after unlocking", sendWithKey(t, client, "voltage", MOSet, "", 5.), RCSuccess)
+	checkRetCode(t, "Unlock while unlocked", sendWithKey(t, client, "psu." + UnlockCommand, MOCommand, "", nil), RCWarnNoAction)
+
+	lockService(t, client, nil)
+	forced := map[string]interface{}{"force": true}
+	checkRetCode(t, "Forced unlock without the key", sendWithKey(t, client, "psu." + UnlockCommand, MOCommand, "", forced), RCSuccess)
+	checkLocked(t, client, false)
+}
+
+func TestMemoryLockoutExpiry(t *testing.T) {
+	// the lock expires after the service's LockTimeout
+	server, client := newLockableService(t, 100 * time.Millisecond)
+	lockService(t, client, nil)
+	checkRetCode(t, "Set while locked", sendWithKey(t, client, "voltage", MOSet, "", 5.), RCErrDripAccDen)
+	time.Sleep(150 * time.Millisecond)
+	if server.IsLocked() {
+		t.Errorf("Lock did not expire after LockTimeout")
+	}
+	checkRetCode(t, "Set after the lock expired", sendWithKey(t, client, "voltage", MOSet, "", 5.), RCSuccess)
+
+	// the timeout in the lock request takes precedence
+	lockService(t, client, map[string]interface{}{"timeout": 0.5})
+	time.Sleep(150 * time.Millisecond)
+	checkLocked(t, client, true)
+	time.Sleep(400 * time.Millisecond)
+	checkLocked(t, client, false)
+
+	// without a LockTimeout, only a lock request with a timeout expires
+	server, client = newLockableService(t, 0)
+	lockService(t, client, nil)
+	time.Sleep(150 * time.Millisecond)
+	checkLocked(t, client, true)
+	sendWithKey(t, client, "psu." + UnlockCommand, MOCommand, "", map[string]interface{}{"force": true})
+	lockService(t, client, map[string]interface{}{"timeout": 0.1})
+	time.Sleep(150 * time.Millisecond)
+	if server.IsLocked() {
+		t.Errorf("Lock did not expire after the timeout of the lock request")
+	}
+}
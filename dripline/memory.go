@@ -0,0 +1,593 @@
+/*
+* memory.go
+*
+* An in-process message broker with topic-exchange routing, for running services without a network connection.
+* Rejected messages are dead-lettered like RabbitMQ does, with x-death and x-first-death-* headers.
+ */
+
+package dripline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// MemoryBroker routes messages between MemoryTransports in the same process.
+// Routing follows the rules of an AMQP topic exchange: routing keys are dot-separated words,
+// and in a binding key "*" matches exactly one word and "#" matches zero or more words.
+// Messages published to the default exchange ("") go to the queue named by the routing key.
+type MemoryBroker struct {
+	lock              sync.Mutex
+	exchanges         map[string]bool
+	queues            map[string]*memoryQueue
+	bindings          []memoryBinding
+	transports        map[*MemoryTransport]bool
+	queueCount        int
+}
+
+type memoryBinding struct {
+	exchange          string
+	routingKey        string
+	queue             string
+}
+
+// NewMemoryBroker creates an empty broker.
+func NewMemoryBroker() (broker *MemoryBroker) {
+	broker = &MemoryBroker {
+		exchanges:  make(map[string]bool),
+		queues:     make(map[string]*memoryQueue),
+		transports: make(map[*MemoryTransport]bool),
+	}
+	return
+}
+
+// NewTransport creates a Transport connected to this broker.
+func (broker *MemoryBroker) NewTransport() (transport *MemoryTransport) {
+	transport = &MemoryTransport{broker: broker}
+	return
+}
+
+// DropConnections disconnects every transport, as if the broker had been restarted.
+// Exchanges and durable queues are kept; other queues, which are exclusive to their transports, are deleted.
+func (broker *MemoryBroker) DropConnections() {
+	broker.lock.Lock()
+	transports := make([]*MemoryTransport, 0, len(broker.transports))
+	for transport := range broker.transports {
+		transports = append(transports, transport)
+	}
+	broker.lock.Unlock()
+
+	for _, transport := range transports {
+		transport.close(&amqp.Error{Code: 320, Reason: "CONNECTION_FORCED - broker forced connection closure"})
+	}
+	return
+}
+
+// deadLetter publishes a message that was rejected from a queue to the queue's dead-letter exchange, if it has one.
+func (broker *MemoryBroker) deadLetter(queue *memoryQueue, delivery amqp.Delivery) {
+	if queue.options.DeadLetterExchange == "" {
+		return
+	}
+	publishing := deliveryPublishing(delivery)
+	publishing.Headers = make(amqp.Table, len(delivery.Headers) + 4)
+	for header, value := range delivery.Headers {
+		publishing.Headers[header] = value
+	}
+	count := int64(1)
+	if deaths, hasDeaths := delivery.Headers[deathHeader].([]interface{}); hasDeaths && len(deaths) > 0 {
+		if death, isTable := deaths[0].(amqp.Table); isTable && death["queue"] == queue.name {
+			if previous, convErr := ConvertToMsgCode(death["count"]); convErr == nil {
+				count += int64(previous)
+			}
+		}
+	}
+	publishing.Headers[deathHeader] = []interface{}{amqp.Table {
+		"count":        count,
+		"reason":       DeadLetterRejected,
+		"queue":        queue.name,
+		"exchange":     delivery.Exchange,
+		"routing-keys": []interface{}{delivery.RoutingKey},
+	}}
+	if _, seen := delivery.Headers[DeathReasonHeader]; seen == false {
+		publishing.Headers[DeathReasonHeader] = DeadLetterRejected
+		publishing.Headers[DeathQueueHeader] = queue.name
+		publishing.Headers[DeathExchangeHeader] = delivery.Exchange
+	}
+
+	routingKey := delivery.RoutingKey
+	if queue.options.DeadLetterRoutingKey != "" {
+		routingKey = queue.options.DeadLetterRoutingKey
+	}
+	// a dead letter that cannot be routed is dropped, as by RabbitMQ
+	broker.publish(queue.options.DeadLetterExchange, routingKey, false, publishing)
+	return
+}
+
+// publish routes a message to every queue bound to the exchange with a matching key.
+// A mandatory message that reaches no queue is an ErrAMQPRK error.
+func (broker *MemoryBroker) publish(exchange, routingKey string, mandatory bool, msg amqp.Publishing) (e error) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	var targets []*memoryQueue
+	if exchange == "" {
+		if queue, exists := broker.queues[routingKey]; exists {
+			targets = append(targets, queue)
+		}
+	} else {
+		if broker.exchanges[exchange] == false {
+			e = fmt.Errorf("Exchange <%s> does not exist", exchange)
+			return
+		}
+		routed := make(map[string]bool)
+		for _, binding := range broker.bindings {
+			if binding.exchange != exchange || routed[binding.queue] || !TopicMatch(binding.routingKey, routingKey) {
+				continue
+			}
+			routed[binding.queue] = true
+			targets = append(targets, broker.queues[binding.queue])
+		}
+	}
+
+	if mandatory && len(targets) == 0 {
+		e = Errorf(RCErrAMQPRK, "No queue is bound to <%s> on exchange <%s>", routingKey, exchange)
+		return
+	}
+
+	for _, queue := range targets {
+		queue.push(amqp.Delivery {
+			Headers:         msg.Headers,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Exchange:        exchange,
+			RoutingKey:      routingKey,
+			Body:            msg.Body,
+		})
+	}
+	return
+}
+
+// deleteQueue removes a queue and its bindings; the broker lock must be held.
+func (broker *MemoryBroker) deleteQueue(name string) {
+	queue, exists := broker.queues[name]
+	if !exists {
+		return
+	}
+	queue.stop()
+	delete(broker.queues, name)
+	bindings := broker.bindings[:0]
+	for _, binding := range broker.bindings {
+		if binding.queue != name {
+			bindings = append(bindings, binding)
+		}
+	}
+	broker.bindings = bindings
+	return
+}
+
+// TopicMatch reports whether a routing key matches a topic-exchange binding key.
+func TopicMatch(bindingKey, routingKey string) bool {
+	return topicMatchWords(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+}
+
+func topicMatchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for skip := 0; skip <= len(words); skip++ {
+			if topicMatchWords(pattern[1:], words[skip:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && words[0] == pattern[0] && topicMatchWords(pattern[1:], words[1:])
+	}
+}
+
+
+//***************************
+//*** In-Memory Transport ***
+//***************************
+
+// MemoryTransport is a Transport connected to a MemoryBroker.
+type MemoryTransport struct {
+	broker            *MemoryBroker
+	connected         bool
+	closed            chan *amqp.Error
+	queues            []string
+	prefetch          int
+}
+
+// Dial connects to the transport's broker; the address is ignored.
+func (transport *MemoryTransport) Dial(address string) (e error) {
+	broker := transport.broker
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	transport.connected = true
+	transport.closed = make(chan *amqp.Error, 1)
+	transport.queues = nil
+	transport.prefetch = 0
+	broker.transports[transport] = true
+	return
+}
+
+// Close disconnects from the broker and deletes the transport's queues.
+func (transport *MemoryTransport) Close() (e error) {
+	transport.close(nil)
+	return
+}
+
+func (transport *MemoryTransport) close(reason *amqp.Error) {
+	broker := transport.broker
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if !transport.connected {
+		return
+	}
+	transport.connected = false
+	delete(broker.transports, transport)
+	for _, name := range transport.queues {
+		broker.deleteQueue(name)
+	}
+	for _, queue := range broker.queues {
+		if queue.consumer == transport {
+			queue.release()
+		}
+	}
+	transport.queues = nil
+	if reason != nil {
+		transport.closed <- reason
+	}
+	close(transport.closed)
+	return
+}
+
+func (transport *MemoryTransport) NotifyClose() <-chan *amqp.Error {
+	return transport.closed
+}
+
+// checkConnected returns an error if the transport is not connected; the broker lock must be held.
+func (transport *MemoryTransport) checkConnected() (e error) {
+	if !transport.connected {
+		e = fmt.Errorf("Transport is not connected to the broker")
+	}
+	return
+}
+
+func (transport *MemoryTransport) ExchangeDeclare(name string) (e error) {
+	broker := transport.broker
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if e = transport.checkConnected(); e != nil {
+		return
+	}
+	broker.exchanges[name] = true
+	return
+}
+
+// QueueDeclare declares a queue; a durable queue has no owner, and is kept until it is deleted.
+func (transport *MemoryTransport) QueueDeclare(name string, options QueueOptions) (queueName string, e error) {
+	broker := transport.broker
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if e = transport.checkConnected(); e != nil {
+		return
+	}
+	if name == "" {
+		broker.queueCount++
+		name = fmt.Sprintf("amq.gen-%d", broker.queueCount)
+	}
+	if queue, exists := broker.queues[name]; exists {
+		if queue.options.Durable == false && queue.owner != transport {
+			e = fmt.Errorf("Queue <%s> is in use by another connection", name)
+			return
+		}
+		if queue.options != options {
+			e = fmt.Errorf("Queue <%s> already exists with different options", name)
+			return
+		}
+		queueName = name
+		return
+	}
+	if options.Durable {
+		broker.queues[name] = newMemoryQueue(name, options, broker, nil)
+	} else {
+		broker.queues[name] = newMemoryQueue(name, options, broker, transport)
+		transport.queues = append(transport.queues, name)
+	}
+	queueName = name
+	return
+}
+
+func (transport *MemoryTransport) QueueBind(queue, routingKey, exchange string) (e error) {
+	broker := transport.broker
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if e = transport.checkConnected(); e != nil {
+		return
+	}
+	if _, exists := broker.queues[queue]; !exists {
+		e = fmt.Errorf("Queue <%s> does not exist", queue)
+		return
+	}
+	if broker.exchanges[exchange] == false {
+		e = fmt.Errorf("Exchange <%s> does not exist", exchange)
+		return
+	}
+	binding := memoryBinding{exchange: exchange, routingKey: routingKey, queue: queue}
+	for _, existing := range broker.bindings {
+		if existing == binding {
+			return
+		}
+	}
+	broker.bindings = append(broker.bindings, binding)
+	return
+}
+
+func (transport *MemoryTransport) QueueDelete(name string) (e error) {
+	broker := transport.broker
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if e = transport.checkConnected(); e != nil {
+		return
+	}
+	broker.deleteQueue(name)
+	for i, owned := range transport.queues {
+		if owned == name {
+			transport.queues = append(transport.queues[:i], transport.queues[i+1:]...)
+			break
+		}
+	}
+	return
+}
+
+func (transport *MemoryTransport) Qos(prefetchCount int) (e error) {
+	broker := transport.broker
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if e = transport.checkConnected(); e != nil {
+		return
+	}
+	transport.prefetch = prefetchCount
+	return
+}
+
+func (transport *MemoryTransport) Consume(queue string) (deliveries <-chan amqp.Delivery, e error) {
+	broker := transport.broker
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if e = transport.checkConnected(); e != nil {
+		return
+	}
+	memQueue, exists := broker.queues[queue]
+	if !exists {
+		e = fmt.Errorf("Queue <%s> does not exist", queue)
+		return
+	}
+	if memQueue.consuming {
+		e = fmt.Errorf("Queue <%s> already has an exclusive consumer", queue)
+		return
+	}
+	memQueue.consuming = true
+	memQueue.consumer = transport
+	memQueue.setPrefetch(transport.prefetch)
+	deliveries = memQueue.out
+	return
+}
+
+func (transport *MemoryTransport) Publish(exchange, routingKey string, mandatory bool, msg amqp.Publishing) (e error) {
+	if e = transport.broker.checkTransport(transport); e != nil {
+		return
+	}
+	e = transport.broker.publish(exchange, routingKey, mandatory, msg)
+	return
+}
+
+// checkTransport returns an error if the transport is not connected.
+func (broker *MemoryBroker) checkTransport(transport *MemoryTransport) (e error) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	e = transport.checkConnected()
+	return
+}
+
+
+//***********************
+//*** In-Memory Queue ***
+//***********************
+
+// memoryQueue holds an unbounded backlog of messages and hands them to its consumer in order.
+// It acts as the Acknowledger for its deliveries; rejected messages can be requeued, or are dead-lettered.
+type memoryQueue struct {
+	name              string
+	options           QueueOptions
+	broker            *MemoryBroker
+	owner             *MemoryTransport
+	consuming         bool
+	consumer          *MemoryTransport
+	in                chan amqp.Delivery
+	out               chan amqp.Delivery
+	released          chan bool
+	settled           chan bool
+	done              chan bool
+	lock              sync.Mutex
+	deliveryTag       uint64
+	unacked           map[uint64]amqp.Delivery
+	prefetch          int
+}
+
+func newMemoryQueue(name string, options QueueOptions, broker *MemoryBroker, owner *MemoryTransport) (queue *memoryQueue) {
+	queue = &memoryQueue {
+		name:     name,
+		options:  options,
+		broker:   broker,
+		owner:    owner,
+		in:       make(chan amqp.Delivery),
+		out:      make(chan amqp.Delivery),
+		released: make(chan bool, 1),
+		settled:  make(chan bool, 1),
+		done:     make(chan bool),
+		unacked:  make(map[uint64]amqp.Delivery),
+	}
+	go queue.run()
+	return
+}
+
+func (queue *memoryQueue) run() {
+	var backlog []amqp.Delivery
+	var next amqp.Delivery
+	for {
+		var out chan amqp.Delivery
+		if len(backlog) > 0 && (next.DeliveryTag != 0 || queue.hasCredit()) {
+			if next.DeliveryTag == 0 {
+				next = queue.track(backlog[0])
+			}
+			out = queue.out
+		}
+		select {
+		case delivery := <-queue.in:
+			backlog = append(backlog, delivery)
+		case out <- next:
+			backlog = backlog[1:]
+			next = amqp.Delivery{}
+		case <-queue.settled:
+			// there may be room for another delivery under the prefetch limit
+		case <-queue.released:
+			// the unacknowledged deliveries, other than the one waiting to be sent, go back to the queue
+			backlog = append(backlog, queue.takeUnacked(next.DeliveryTag)...)
+		case <-queue.done:
+			close(queue.out)
+			return
+		}
+	}
+}
+
+// hasCredit reports whether the consumer can be sent another delivery under the prefetch limit.
+func (queue *memoryQueue) hasCredit() bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.prefetch <= 0 || len(queue.unacked) < queue.prefetch
+}
+
+func (queue *memoryQueue) setPrefetch(prefetch int) {
+	queue.lock.Lock()
+	queue.prefetch = prefetch
+	queue.lock.Unlock()
+	select {
+	case queue.settled <- true:
+	default:
+	}
+	return
+}
+
+// track assigns a delivery tag to a message that is about to be delivered and remembers it until it is acknowledged.
+func (queue *memoryQueue) track(delivery amqp.Delivery) amqp.Delivery {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.deliveryTag++
+	delivery.DeliveryTag = queue.deliveryTag
+	delivery.Acknowledger = queue
+	queue.unacked[delivery.DeliveryTag] = delivery
+	return delivery
+}
+
+func (queue *memoryQueue) push(delivery amqp.Delivery) {
+	delivery.DeliveryTag = 0
+	select {
+	case queue.in <- delivery:
+	case <-queue.done:
+	}
+	return
+}
+
+// release drops the queue's consumer, whose unacknowledged deliveries are then requeued; the broker lock must be held.
+func (queue *memoryQueue) release() {
+	queue.consuming = false
+	queue.consumer = nil
+	select {
+	case queue.released <- true:
+	default:
+	}
+	return
+}
+
+// takeUnacked removes the unacknowledged deliveries, except the one with the tag keep, and returns them in delivery order, marked as redelivered.
+func (queue *memoryQueue) takeUnacked(keep uint64) (deliveries []amqp.Delivery) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for tag, delivery := range queue.unacked {
+		if tag == keep {
+			continue
+		}
+		delete(queue.unacked, tag)
+		delivery.Redelivered = true
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].DeliveryTag < deliveries[j].DeliveryTag })
+	for i := range deliveries {
+		deliveries[i].DeliveryTag = 0
+	}
+	return
+}
+
+func (queue *memoryQueue) stop() {
+	close(queue.done)
+	return
+}
+
+// settle removes acknowledged deliveries; with multiple, all deliveries up to and including tag are settled.
+func (queue *memoryQueue) settle(tag uint64, multiple bool) (settled []amqp.Delivery) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for unackedTag, delivery := range queue.unacked {
+		if unackedTag == tag || (multiple && unackedTag < tag) {
+			settled = append(settled, delivery)
+			delete(queue.unacked, unackedTag)
+		}
+	}
+	select {
+	case queue.settled <- true:
+	default:
+	}
+	return
+}
+
+func (queue *memoryQueue) Ack(tag uint64, multiple bool) error {
+	queue.settle(tag, multiple)
+	return nil
+}
+
+func (queue *memoryQueue) Nack(tag uint64, multiple bool, requeue bool) error {
+	for _, delivery := range queue.settle(tag, multiple) {
+		if requeue {
+			delivery.Redelivered = true
+			go queue.push(delivery)
+		} else {
+			queue.broker.deadLetter(queue, delivery)
+		}
+	}
+	return nil
+}
+
+func (queue *memoryQueue) Reject(tag uint64, requeue bool) error {
+	return queue.Nack(tag, false, requeue)
+}
@@ -0,0 +1,147 @@
+/*
+* memory_test.go
+*
+* Tests of the in-memory broker, and of services talking to each other through it.
+ */
+
+package dripline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		bindingKey string
+		routingKey string
+		match      bool
+	}{
+		{"psu", "psu", true},
+		{"psu", "psu2", false},
+		{"psu", "psu.voltage", false},
+		{"psu.voltage", "psu.voltage", true},
+		{"psu.*", "psu.voltage", true},
+		{"psu.*", "psu", false},
+		{"psu.*", "psu.ch1.voltage", false},
+		{"*.voltage", "psu.voltage", true},
+		{"*", "psu", true},
+		{"*", "", true},
+		{"psu.#", "psu", true},
+		{"psu.#", "psu.voltage", true},
+		{"psu.#", "psu.ch1.voltage", true},
+		{"psu.#", "pump.voltage", false},
+		{"#", "psu.ch1.voltage", true},
+		{"#", "", true},
+		{"#.voltage", "voltage", true},
+		{"#.voltage", "psu.ch1.voltage", true},
+		{"#.voltage", "psu.ch1.current", false},
+		{"psu.#.voltage", "psu.voltage", true},
+		{"psu.#.voltage", "psu.ch1.ch2.voltage", true},
+		{"psu.*.#", "psu", false},
+		{"psu.*.#", "psu.ch1", true},
+		{"psu.*.#", "psu.ch1.voltage", true},
+	}
+	for _, test := range tests {
+		if match := TopicMatch(test.bindingKey, test.routingKey); match != test.match {
+			t.Errorf("TopicMatch(%q, %q) = %v, expected %v", test.bindingKey, test.routingKey, match, test.match)
+		}
+	}
+}
+
+func TestMemoryRequestReply(t *testing.T) {
+	broker := NewMemoryBroker()
+	server := newTestService(t, broker, "server")
+	if e := server.SubscribeToRequests("server.#"); e != nil {
+		t.Fatal(e)
+	}
+	client := newTestService(t, broker, "")
+
+	go func() {
+		for request := range server.Receiver.RequestChan {
+			reply := PrepareReplyToRequest(request, RCSuccess, "handled "+request.Target, SenderInfo{})
+			reply.Payload = request.Payload
+			server.SendReply(reply)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request := PrepareRequest("server.voltage", "application/json", MOGet, SenderInfo{})
+	request.Payload = map[string]interface{}{"values": []interface{}{"on", 1.5}}
+	reply, e := client.SendRequestContext(ctx, request)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if reply.RetCode != RCSuccess || reply.ReturnMessage != "handled server.voltage" {
+		t.Errorf("Unexpected reply: %d %q", reply.RetCode, reply.ReturnMessage)
+	}
+	if reflect.DeepEqual(reply.Payload, request.Payload) == false {
+		t.Errorf("Reply payload is %#v, expected %#v", reply.Payload, request.Payload)
+	}
+
+	// a request that cannot be routed is answered by the client's own service
+	reply, e = client.SendRequestContext(ctx, PrepareRequest("nobody", "application/json", MOGet, SenderInfo{}))
+	if e != nil || reply.RetCode != RCErrAMQPRK {
+		t.Errorf("Request to a target that no queue is bound to got RetCode %d and error %v, expected %d", reply.RetCode, e, RCErrAMQPRK)
+	}
+}
+
+func TestMemoryAlert(t *testing.T) {
+	broker := NewMemoryBroker()
+	listener := newTestService(t, broker, "listener")
+	if e := listener.SubscribeToAlerts("sensor.#"); e != nil {
+		t.Fatal(e)
+	}
+	sender := newTestService(t, broker, "")
+
+	alert := PrepareAlert("sensor.temperature", "application/json", SenderInfo{})
+	alert.Payload = 21.5
+	if e := sender.SendAlert(alert); e != nil {
+		t.Fatal(e)
+	}
+	select {
+	case received := <-listener.Receiver.AlertChan:
+		if received.Target != "sensor.temperature" || received.Payload != 21.5 {
+			t.Errorf("Unexpected alert to <%s> with payload %#v", received.Target, received.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Alert was not received")
+	}
+
+	if e := sender.SendAlert(PrepareAlert("pump.pressure", "application/json", SenderInfo{})); e == nil {
+		t.Errorf("Alert that no queue is bound to should fail")
+	}
+}
+
+func TestMemoryReconnect(t *testing.T) {
+	broker := NewMemoryBroker()
+	server := newTestService(t, broker, "server", func(service *AmqpService) {
+		service.Reconnect.InitialInterval = 10 * time.Millisecond
+	})
+	if e := server.AddEndpoint("echo", echoEndpoint{}); e != nil {
+		t.Fatal(e)
+	}
+	client := newTestService(t, broker, "", func(service *AmqpService) {
+		service.Reconnect.InitialInterval = 10 * time.Millisecond
+	})
+
+	broker.DropConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		value, e := Call[float64, float64](ctx, client, "echo", MOGet, 2.5)
+		if e == nil {
+			if value != 2.5 {
+				t.Errorf("Reply after reconnecting is %v, expected 2.5", value)
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("No reply after reconnecting: %v", e)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
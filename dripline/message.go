@@ -11,13 +11,10 @@ package dripline
 import (
 	"fmt"
 	"time"
-	"unsafe"
 
 	"github.com/streadway/amqp"
-	"github.com/ugorji/go/codec"
 
 	"github.com/project8/swarm/Go/logging"
-	"github.com/project8/swarm/Go/utility"
 )
 
 type SenderInfo struct {
@@ -31,6 +28,8 @@ type SenderInfo struct {
 
 type Message struct {
 	exchange   string
+	sent       chan error
+	ack        *deliveryAck
     Target     string
 	Encoding   string
 	ReplyTo    string
@@ -39,11 +38,18 @@ type Message struct {
 	TimeStamp  string
 	SenderInfo
 	Payload    interface{}
+	// WireVersion is the format the message was received in; when sending, zero means the service's format
+	WireVersion WireVersion
+	// Extra holds the elements of a received message that this package does not know, and they are sent along with the message,
+	// so that a message can be passed on without losing what a newer sender put in it
+	Extra      map[string]interface{}
 }
 
 type Request struct {
     Message
 	MsgOp         MsgCodeT
+	Specifier     string
+	LockoutKey    string
 }
 
 type Reply struct {
@@ -69,7 +75,11 @@ func (message *Message) messageBuffer() (buffer map[string]interface{}) {
 		"hostname": (*message).SenderInfo.Hostname,
 		"username": (*message).SenderInfo.Username,
 	}
-	buffer = make(map[string]interface{})
+	buffer = make(map[string]interface{}, len((*message).Extra) + 4)
+	// the known elements take precedence over any extra elements with the same names
+	for element, value := range (*message).Extra {
+		buffer[element] = value
+	}
 	buffer["msgtype"] = (*message).MsgType
 	buffer["timestamp"] = (*message).TimeStamp
 	buffer["sender_info"] = senderInfo
@@ -77,124 +87,169 @@ func (message *Message) messageBuffer() (buffer map[string]interface{}) {
 	return
 }
 
-// Encode converts an Request message into a byte stream
-func (message *Request) Encode() (body []byte, e error) {
-	buffer := (*message).messageBuffer()
+func (message *Request) elements() (buffer map[string]interface{}) {
+	buffer = (*message).messageBuffer()
 	buffer["msgop"] = (*message).MsgOp
-	body, e = encodeBuffer(&buffer, (*message).Encoding)
+	if (*message).Specifier != "" {
+		buffer["specifier"] = (*message).Specifier
+	}
+	if (*message).LockoutKey != "" {
+		buffer["lockout_key"] = (*message).LockoutKey
+	}
 	return
 }
 
-// Encode converts an Reply message into a byte stream
-func (message *Reply) Encode() (body []byte, e error) {
-	buffer := (*message).messageBuffer()
+func (message *Reply) elements() (buffer map[string]interface{}) {
+	buffer = (*message).messageBuffer()
 	buffer["retcode"] = (*message).RetCode
 	buffer["return_msg"] = (*message).ReturnMessage
+	return
+}
+
+func (message *Alert) elements() (buffer map[string]interface{}) {
+	buffer = (*message).messageBuffer()
+	return
+}
+
+func (message *Info) elements() (buffer map[string]interface{}) {
+	buffer = (*message).messageBuffer()
+	return
+}
+
+// Encode converts an Request message into a v1 byte stream
+func (message *Request) Encode() (body []byte, e error) {
+	buffer := (*message).elements()
 	body, e = encodeBuffer(&buffer, (*message).Encoding)
 	return
 }
 
-// Encode converts an Alert message into a byte stream
+// Encode converts an Reply message into a v1 byte stream
+func (message *Reply) Encode() (body []byte, e error) {
+	buffer := (*message).elements()
+	body, e = encodeBuffer(&buffer, (*message).Encoding)
+	return
+}
+
+// Encode converts an Alert message into a v1 byte stream
 func (message *Alert) Encode() (body []byte, e error) {
-	buffer := (*message).messageBuffer()
+	buffer := (*message).elements()
 	body, e = encodeBuffer(&buffer, (*message).Encoding)
 	return
 }
 
-// Encode converts an Info message into a byte stream
+// Encode converts an Info message into a v1 byte stream
 func (message *Info) Encode() (body []byte, e error) {
-	buffer := (*message).messageBuffer()
+	buffer := (*message).elements()
 	body, e = encodeBuffer(&buffer, (*message).Encoding)
 	return
 }
 
 func encodeBuffer(bufferPtr *map[string]interface{}, encoding string) (encoded []byte, e error) {
-	switch encoding {
-	case "application/json":
-		//log.Printf("this will be a json message")
-		encoded, e = utility.IfcToJSON(*bufferPtr)
-		//handle := new(codec.JsonHandle)
-		//encoder := codec.NewEncoderBytes(&(encoded), handle)
-		//jsonErr := encoder.Encode(buffer)
-		if e != nil {
-			e = fmt.Errorf("Unable to encode JSON-encoded message: %v", e)
-		}
-	case "application/msgpack":
-		//log.Printf("this will be a msgpack message")
-		encoded = make([]byte, 0, unsafe.Sizeof(*bufferPtr))
-		handle := new(codec.MsgpackHandle)
-		encoder := codec.NewEncoderBytes(&(encoded), handle)
-		msgpackErr := encoder.Encode(*bufferPtr)
-		if msgpackErr != nil {
-			e = fmt.Errorf("Unable to encode msgpack-encoded message: %v", msgpackErr)
-		}
-	default:
-		e = fmt.Errorf("Message content cannot be encoded with type <%s>", encoding)
+	bodyCodec, registered := LookupCodec(encoding)
+	if registered == false {
+		e = Errorf(RCErrDripNoEnc, "Message content cannot be encoded with type <%s>", encoding)
+		return
+	}
+	if encoded, e = bodyCodec.Marshal(*bufferPtr); e != nil {
+		e = fmt.Errorf("Unable to encode %s-encoded message: %v", encoding, e)
 	}
 	return
 }
 
 // DecodeAndHandle converts an AMQP Delivery into one of the message objects, and calls the relevant callback function on it
+// Both wire formats are understood; the format of the delivery is recorded in the message's WireVersion.
+// Malformed messages are reported with a *DecodeError naming the offending element.
 func DecodeAndHandle(amqpMessage *(amqp.Delivery), reqFunc func(Request), replyFunc func(Reply), alertFunc func(Alert), infoFunc func(Info)) (e error) {
-	if buffer, message, msgErr := decode(amqpMessage); msgErr != nil {
-		e = msgErr
+	if amqpMessage == nil {
+		e = &DecodeError{Field: "body", Reason: "no message"}
 		return
-	} else {
-		message.ReplyTo = amqpMessage.ReplyTo
-		switch message.MsgType {
-		case MTRequest:
-			if msgopIfc, msgopPresent := buffer["msgop"]; msgopPresent == false {
-				logging.Log.Errorf("Request message is missing a required element:\n\tmsgop: %v", msgopPresent)
-				e = fmt.Errorf("Request message is missing a required element:\n\tmsgop: %v", msgopPresent)
-				return
-			} else {
-				request := Request {
-					Message: message,
-					MsgOp:   ConvertToMsgCode(msgopIfc),
-				}
-				reqFunc(request)
-				return
-			}
-		case MTReply:
-			retcodeIfc, retcodePresent := buffer["retcode"]
-			if retcodePresent == false {
-				e = fmt.Errorf("Message is missing a required element: retcode: %v", retcodePresent)
+	}
+	buffer, message, e := decode(amqpMessage)
+	if e != nil {
+		return
+	}
+	message.ReplyTo = amqpMessage.ReplyTo
+	switch message.MsgType {
+	case MTRequest:
+		msgopIfc, msgopPresent := buffer["msgop"]
+		if msgopPresent == false {
+			e = &DecodeError{Field: "msgop", Reason: "missing"}
+			return
+		}
+		msgop, convErr := ConvertToMsgCode(msgopIfc)
+		if convErr != nil {
+			e = &DecodeError{Field: "msgop", Reason: convErr.Error()}
+			return
+		}
+		request := Request {
+			Message: message,
+			MsgOp:   msgop,
+		}
+		if specifierIfc, hasSpecifier := buffer["specifier"]; hasSpecifier && specifierIfc != nil {
+			var isString bool
+			if request.Specifier, isString = stringValue(specifierIfc); isString == false {
+				e = &DecodeError{Field: "specifier", Reason: fmt.Sprintf("expected a string, got %T", specifierIfc)}
 				return
 			}
-			retmsgIfc, retmsgPresent := buffer["return_msg"]
-			if retmsgPresent == false {
-				e = fmt.Errorf("Message is missing a required element: return_msg: %v", retmsgPresent)
+		}
+		if lockoutKeyIfc, hasKey := buffer["lockout_key"]; hasKey && lockoutKeyIfc != nil {
+			var isString bool
+			if request.LockoutKey, isString = stringValue(lockoutKeyIfc); isString == false {
+				e = &DecodeError{Field: "lockout_key", Reason: fmt.Sprintf("expected a string, got %T", lockoutKeyIfc)}
 				return
 			}
-			reply := Reply {
-				Message: message,
-				RetCode: ConvertToMsgCode(retcodeIfc),
-				ReturnMessage: retmsgIfc.(string),
-			}
-			replyFunc(reply)
-			return
-		case MTAlert:
-			alert := Alert {
-				Message: message,
-			}
-			alertFunc(alert)
+		}
+		reqFunc(request)
+	case MTReply:
+		retcodeIfc, retcodePresent := buffer["retcode"]
+		if retcodePresent == false {
+			e = &DecodeError{Field: "retcode", Reason: "missing"}
 			return
-		case MTInfo:
-			info := Info {
-				Message: message,
-			}
-			infoFunc(info)
+		}
+		retcode, convErr := ConvertToMsgCode(retcodeIfc)
+		if convErr != nil {
+			e = &DecodeError{Field: "retcode", Reason: convErr.Error()}
 			return
-		default:
-			e = fmt.Errorf("Unknown message type: %v", message.MsgType)
+		}
+		retmsg, retmsgErr := stringField(buffer, "return_msg")
+		if retmsgErr != nil {
+			e = retmsgErr
 			return
 		}
+		reply := Reply {
+			Message: message,
+			RetCode: retcode,
+			ReturnMessage: retmsg,
+		}
+		replyFunc(reply)
+	case MTAlert:
+		alert := Alert {
+			Message: message,
+		}
+		alertFunc(alert)
+	case MTInfo:
+		info := Info {
+			Message: message,
+		}
+		infoFunc(info)
+	default:
+		e = &DecodeError{Field: "msgtype", Reason: fmt.Sprintf("unknown message type %v", message.MsgType)}
 	}
 	return
 }
 
 func decode(amqpMessage *amqp.Delivery) (buffer map[string]interface{}, message Message, e error) {
-	buffer, e = decodeBuffer(amqpMessage.Body, amqpMessage.ContentEncoding)
+	body, mimeType, e := decompressDelivery(amqpMessage)
+	if e != nil {
+		return
+	}
+	wireVersion := WireV1
+	if isV2(amqpMessage.Headers) {
+		wireVersion = WireV2
+		buffer, e = decodeV2(amqpMessage.Headers, body, mimeType)
+	} else {
+		buffer, e = decodeBuffer(body, mimeType)
+	}
 	if e != nil {
 		return
 	}
@@ -202,30 +257,68 @@ func decode(amqpMessage *amqp.Delivery) (buffer map[string]interface{}, message
 	// Message contents validation
 	// required elements: msgtype, timestamp, sender_info
 	msgTypeIfc, msgtypePresent := buffer["msgtype"]
-	timestampIfc, timestampPresent := buffer["timestamp"]
+	if msgtypePresent == false {
+		e = &DecodeError{Field: "msgtype", Reason: "missing"}
+		return
+	}
+	msgType, convErr := ConvertToMsgCode(msgTypeIfc)
+	if convErr != nil {
+		e = &DecodeError{Field: "msgtype", Reason: convErr.Error()}
+		return
+	}
+
+	timestamp, e := stringField(buffer, "timestamp")
+	if e != nil {
+		return
+	}
+
 	senderInfoIfc, senderInfoPresent := buffer["sender_info"]
-	if msgtypePresent && timestampPresent && senderInfoPresent == false {
-		e = fmt.Errorf("Message is missing a required element:\n\tmsgtype: %v\n\ttimestamp: %v\n\tsender_info: %v", msgtypePresent, timestampPresent, senderInfoPresent)
+	if senderInfoPresent == false {
+		e = &DecodeError{Field: "sender_info", Reason: "missing"}
+		return
+	}
+	senderInfoMap, isMap := stringMap(senderInfoIfc)
+	if isMap == false {
+		e = &DecodeError{Field: "sender_info", Reason: fmt.Sprintf("expected a map, got %T", senderInfoIfc)}
 		return
 	}
-	msgType := ConvertToMsgCode(msgTypeIfc)
+
+	// The sender_info elements are all optional, but must be strings if present
+	var senderInfo SenderInfo
+	senderInfoFields := []struct {
+		name  string
+		value *string
+	}{
+		{"package", &senderInfo.Package},
+		{"exe", &senderInfo.Exe},
+		{"version", &senderInfo.Version},
+		{"commit", &senderInfo.Commit},
+		{"hostname", &senderInfo.Hostname},
+		{"username", &senderInfo.Username},
+	}
+	for _, field := range senderInfoFields {
+		valueIfc, present := senderInfoMap[field.name]
+		if present == false || valueIfc == nil {
+			continue
+		}
+		value, isString := stringValue(valueIfc)
+		if isString == false {
+			e = &DecodeError{Field: "sender_info." + field.name, Reason: fmt.Sprintf("expected a string, got %T", valueIfc)}
+			return
+		}
+		*field.value = value
+	}
 
 	// Translate the body of the message into a P8Message object
-	senderInfo := senderInfoIfc.(map[interface{}]interface{})
 	message = Message {
 		Target:     amqpMessage.RoutingKey,
-		Encoding:   amqpMessage.ContentEncoding,
+		Encoding:   mimeType,
 		CorrId:     amqpMessage.CorrelationId,
 		MsgType:    msgType,
-		TimeStamp:  ConvertToString(timestampIfc),
-		SenderInfo: SenderInfo{
-			Package:  ConvertToString(senderInfo["package"]),
-			Exe:      ConvertToString(senderInfo["exe"]),
-			Version:  ConvertToString(senderInfo["version"]),
-			Commit:   ConvertToString(senderInfo["commit"]),
-			Hostname: ConvertToString(senderInfo["hostname"]),
-			Username: ConvertToString(senderInfo["username"]),
-		},
+		TimeStamp:  timestamp,
+		SenderInfo: senderInfo,
+		WireVersion: wireVersion,
+		Extra:      extraElements(buffer, msgType),
 	}
 
 	if payloadIfc, hasPayload := buffer["payload"]; hasPayload {
@@ -234,29 +327,56 @@ func decode(amqpMessage *amqp.Delivery) (buffer map[string]interface{}, message
 	return
 }
 
-func decodeBuffer(encoded []byte, encoding string) (buffer map[string]interface{}, e error) {
-	switch encoding {
-	case "application/json":
-		//log.Printf("this is a json message")
-		buffer, e = utility.JSONToIfc(encoded)
-		//handle := new(codec.JsonHandle)
-		//decoder := codec.NewDecoderBytes(encoded, handle)
-		//jsonErr := decoder.Decode(&buffer)
-		if e != nil {
-			logging.Log.Errorf("Unable to decode JSON-encoded message:\n\t%v", e)
+// knownElements lists the elements of a message body that are decoded into the fields of each message type.
+var knownElements = map[MsgCodeT][]string {
+	MTRequest: {"msgop", "specifier", "lockout_key"},
+	MTReply:   {"retcode", "return_msg"},
+	MTAlert:   {},
+	MTInfo:    {},
+}
+
+// extraElements collects the elements of a message body that are not known for its type; it returns nil if there are none.
+func extraElements(buffer map[string]interface{}, msgType MsgCodeT) (extra map[string]interface{}) {
+	known := map[string]bool{"msgtype": true, "timestamp": true, "sender_info": true, "payload": true}
+	for _, element := range knownElements[msgType] {
+		known[element] = true
+	}
+	for element, value := range buffer {
+		if known[element] {
+			continue
 		}
-	case "application/msgpack":
-		//log.Printf("this is a msgpack message")
-		handle := new(codec.MsgpackHandle)
-		decoder := codec.NewDecoderBytes(encoded, handle)
-		msgpackErr := decoder.Decode(&buffer)
-		if msgpackErr != nil {
-			logging.Log.Errorf("Unable to decode msgpack-encoded message:\n\t%v", msgpackErr)
-			e = msgpackErr
+		if extra == nil {
+			extra = make(map[string]interface{})
 		}
-	default:
+		extra[element] = normalizePayload(value)
+	}
+	return
+}
+
+// stringField gets a required string element from a decoded message body.
+func stringField(buffer map[string]interface{}, field string) (value string, e error) {
+	valueIfc, present := buffer[field]
+	if present == false {
+		e = &DecodeError{Field: field, Reason: "missing"}
+		return
+	}
+	value, isString := stringValue(valueIfc)
+	if isString == false {
+		e = &DecodeError{Field: field, Reason: fmt.Sprintf("expected a string, got %T", valueIfc)}
+	}
+	return
+}
+
+func decodeBuffer(encoded []byte, encoding string) (buffer map[string]interface{}, e error) {
+	bodyCodec, registered := LookupCodec(encoding)
+	if registered == false {
 		logging.Log.Errorf("Message content encoding is not understood: %s", encoding)
-		e = fmt.Errorf("Message content encoding is not understood: %s", encoding)
+		e = Errorf(RCErrDripNoEnc, "Message content encoding is not understood: %s", encoding)
+		return
+	}
+	if decodeErr := bodyCodec.Unmarshal(encoded, &buffer); decodeErr != nil {
+		logging.Log.Errorf("Unable to decode %s-encoded message:\n\t%v", encoding, decodeErr)
+		e = Errorf(RCErrDripDecFail, "Unable to decode %s-encoded message: %v", encoding, decodeErr)
 	}
 	return
 }
@@ -312,6 +432,8 @@ func PrepareReply(target string, encoding string, corrId string, retCode MsgCode
 
 func PrepareReplyToRequest(request Request, retCode MsgCodeT, returnMessage string, senderInfo SenderInfo) (message Reply) {
 	message = PrepareReply(request.ReplyTo, request.Encoding, request.CorrId, retCode, returnMessage, senderInfo)
+	// reply in the format that the requester used
+	message.WireVersion = request.WireVersion
 	return
 }
 
@@ -0,0 +1,187 @@
+/*
+* message_test.go
+*
+* Tests of encoding messages and decoding them with DecodeAndHandle.
+ */
+
+package dripline
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// testEncodings are the encodings that every message is round-tripped through
+var testEncodings = []string{"application/json", "application/msgpack", "application/cbor"}
+
+// deliveryOf encodes a message in the given wire format, and gives the delivery that a consumer of its target would receive.
+func deliveryOf(message encodable, version WireVersion) (delivery amqp.Delivery, e error) {
+	publishing, e := encodePublishing(message, version)
+	if e != nil {
+		return
+	}
+	delivery = amqp.Delivery {
+		Headers:         publishing.Headers,
+		ContentEncoding: publishing.ContentEncoding,
+		CorrelationId:   publishing.CorrelationId,
+		ReplyTo:         publishing.ReplyTo,
+		RoutingKey:      message.base().Target,
+		Body:            publishing.Body,
+	}
+	return
+}
+
+// roundTripPayload has nested maps and lists, and a byte string, which JSON cannot carry as such: it is written as base64 text
+// and decoded as a string.  Numbers are floats, which every encoding decodes as float64.
+func roundTripPayload(encoding string) (payload map[string]interface{}) {
+	data := []byte{0x00, 0x01, 0xfe, 0xff}
+	var dataValue interface{} = data
+	if encoding == "application/json" {
+		dataValue = base64.StdEncoding.EncodeToString(data)
+	}
+	payload = map[string]interface{} {
+		"values":  []interface{}{1.5, "on", true, nil},
+		"channel": map[string]interface{} {
+			"name":   "ch1",
+			"limits": map[string]interface{}{"low": -2.5, "high": 12.},
+			"data":   dataValue,
+		},
+		"data":    dataValue,
+	}
+	return
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	sender := PrepareSenderInfo("dripline", "test", "v1.2.3", "abcdef", "host", "user")
+	tests := []struct {
+		name    string
+		message func(encoding string, payload interface{}) encodable
+	}{
+		{"request", func(encoding string, payload interface{}) encodable {
+			request := PrepareRequest("psu.voltage", encoding, MOSet, sender)
+			request.Specifier = "ch1"
+			request.LockoutKey = "0123"
+			request.Payload = payload
+			return &request
+		}},
+		{"reply", func(encoding string, payload interface{}) encodable {
+			reply := PrepareReply("client", encoding, "", RCErrDripValue, "Value is out of range", sender)
+			reply.Payload = payload
+			return &reply
+		}},
+		{"alert", func(encoding string, payload interface{}) encodable {
+			alert := PrepareAlert("sensor.temperature", encoding, sender)
+			alert.Payload = payload
+			return &alert
+		}},
+		{"info", func(encoding string, payload interface{}) encodable {
+			info := PrepareInfo("client", encoding, "", sender)
+			info.Payload = payload
+			return &info
+		}},
+	}
+
+	for _, test := range tests {
+		for _, encoding := range testEncodings {
+			for _, version := range []WireVersion{WireV1, WireV2} {
+				t.Run(fmt.Sprintf("%s/%s/v%d", test.name, encoding, version), func(t *testing.T) {
+					sent := test.message(encoding, roundTripPayload("application/msgpack"))
+					expected := test.message(encoding, roundTripPayload(encoding))
+					for _, message := range []*Message{sent.base(), expected.base()} {
+						message.CorrId = "corr"
+						message.ReplyTo = "client"
+						message.TimeStamp = "2026-10-16T12:00:00.000000Z"
+					}
+					expected.base().exchange = ""
+					expected.base().WireVersion = version
+
+					delivery, e := deliveryOf(sent, version)
+					if e != nil {
+						t.Fatal(e)
+					}
+					var decoded interface{}
+					e = DecodeAndHandle(&delivery,
+						func(request Request) {
+							request.Payload = normalizePayload(request.Payload)
+							decoded = &request
+						},
+						func(reply Reply) {
+							reply.Payload = normalizePayload(reply.Payload)
+							decoded = &reply
+						},
+						func(alert Alert) {
+							alert.Payload = normalizePayload(alert.Payload)
+							decoded = &alert
+						},
+						func(info Info) {
+							info.Payload = normalizePayload(info.Payload)
+							decoded = &info
+						})
+					if e != nil {
+						t.Fatal(e)
+					}
+					if reflect.DeepEqual(decoded, expected) == false {
+						t.Errorf("Decoded message is\n\t%#v\nexpected\n\t%#v", decoded, expected)
+					}
+				})
+			}
+		}
+	}
+}
+
+// FuzzDecodeAndHandle checks that DecodeAndHandle either rejects a delivery with an error or hands it to exactly one callback.
+// The v2 deliveries have the headers of a v2 request, and the fuzzed body is their payload.
+func FuzzDecodeAndHandle(f *testing.F) {
+	v2Headers := make(map[string]amqp.Table, len(testEncodings))
+	for _, encoding := range testEncodings {
+		messages := []encodable{}
+		request := PrepareRequest("psu.voltage", encoding, MOSet, SenderInfo{Exe: "fuzz"})
+		request.Specifier = "ch1"
+		reply := PrepareReply("client", encoding, "corr", RCErrDripValue, "Value is out of range", SenderInfo{})
+		alert := PrepareAlert("sensor.temperature", encoding, SenderInfo{})
+		info := PrepareInfo("client", encoding, "corr", SenderInfo{})
+		messages = append(messages, &request, &reply, &alert, &info)
+		for _, message := range messages {
+			message.base().Payload = roundTripPayload(encoding)
+			for _, version := range []WireVersion{WireV1, WireV2} {
+				delivery, e := deliveryOf(message, version)
+				if e != nil {
+					f.Fatal(e)
+				}
+				f.Add(encoding, version == WireV2, delivery.Body)
+			}
+		}
+		requestDelivery, e := deliveryOf(&request, WireV2)
+		if e != nil {
+			f.Fatal(e)
+		}
+		v2Headers[encoding] = requestDelivery.Headers
+	}
+
+	f.Fuzz(func(t *testing.T, encoding string, v2 bool, body []byte) {
+		delivery := amqp.Delivery {
+			ContentEncoding: encoding,
+			RoutingKey:      "psu.voltage",
+			Body:            body,
+		}
+		if v2 {
+			delivery.Headers = v2Headers[encoding]
+		}
+		handled := 0
+		e := DecodeAndHandle(&delivery,
+			func(Request) { handled++ },
+			func(Reply) { handled++ },
+			func(Alert) { handled++ },
+			func(Info) { handled++ })
+		if e == nil && handled != 1 {
+			t.Errorf("Decoded delivery was handled %d times", handled)
+		}
+		if e != nil && handled != 0 {
+			t.Errorf("Delivery was handled, but decoding failed: %v", e)
+		}
+	})
+}
@@ -0,0 +1,254 @@
+/*
+* ndarray.go
+*
+* Typed numeric arrays for payloads.
+*
+* An NDArray is sent as a map with the elements "dtype", "shape", and "data", where dtype is a numpy type string such as "<f8",
+* and data holds the elements in C order as little-endian binary.  In Python the array is restored with
+* numpy.frombuffer(data, dtype).reshape(shape).
+*
+* Binary codecs carry the data as a byte string; JSON carries it as base64 text.
+ */
+
+package dripline
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Numeric is the set of element types of an NDArray.
+type Numeric interface {
+	~int8 | ~int16 | ~int32 | ~int64 | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~float32 | ~float64
+}
+
+// NDArray is a numeric array in the layout of a numpy array.
+// Use AsNDArray or DecodePayload to read one from a payload, on its own or nested in a struct; the data may be bytes or base64 text.
+type NDArray struct {
+	DType             string  `codec:"dtype" json:"dtype"`
+	Shape             []int   `codec:"shape" json:"shape"`
+	Data              []byte  `codec:"data" json:"data"`
+}
+
+// NewNDArray creates an array of the given values.
+// Without a shape, the array is one-dimensional; otherwise the shape must match the number of values.
+func NewNDArray[T Numeric](values []T, shape ...int) (array NDArray, e error) {
+	if len(shape) == 0 {
+		shape = []int{len(values)}
+	}
+	if count := shapeSize(shape); count != len(values) {
+		e = Errorf(RCErrDripPayload, "Shape %v holds %d elements, but there are %d values", shape, count, len(values))
+		return
+	}
+	kind, size := numericKind[T]()
+	var data bytes.Buffer
+	data.Grow(len(values) * size)
+	if e = binary.Write(&data, binary.LittleEndian, values); e != nil {
+		e = Errorf(RCErrDripPayload, "Unable to encode the array data: %v", e)
+		return
+	}
+	array = NDArray {
+		DType: "<" + string(kind) + strconv.Itoa(size),
+		Shape: append([]int(nil), shape...),
+		Data:  data.Bytes(),
+	}
+	return
+}
+
+// NDArrayValues returns the elements of an array, in C order, as values of type T.
+// Elements of a different dtype are converted, as with a Go type conversion.
+func NDArrayValues[T Numeric](array NDArray) (values []T, e error) {
+	kind, size, order, e := parseDType(array.DType)
+	if e != nil {
+		return
+	}
+	count := len(array.Data) / size
+	if len(array.Data) % size != 0 || (array.Shape != nil && shapeSize(array.Shape) != count) {
+		e = Errorf(RCErrDripPayload, "Array data of %d bytes does not match dtype %s and shape %v", len(array.Data), array.DType, array.Shape)
+		return
+	}
+
+	if wantKind, wantSize := numericKind[T](); wantKind == kind && wantSize == size {
+		values = make([]T, count)
+		e = binary.Read(bytes.NewReader(array.Data), order, values)
+	} else {
+		switch string(kind) + strconv.Itoa(size) {
+		case "i1":
+			values, e = readConverted[T, int8](array.Data, order, count)
+		case "i2":
+			values, e = readConverted[T, int16](array.Data, order, count)
+		case "i4":
+			values, e = readConverted[T, int32](array.Data, order, count)
+		case "i8":
+			values, e = readConverted[T, int64](array.Data, order, count)
+		case "u1":
+			values, e = readConverted[T, uint8](array.Data, order, count)
+		case "u2":
+			values, e = readConverted[T, uint16](array.Data, order, count)
+		case "u4":
+			values, e = readConverted[T, uint32](array.Data, order, count)
+		case "u8":
+			values, e = readConverted[T, uint64](array.Data, order, count)
+		case "f4":
+			values, e = readConverted[T, float32](array.Data, order, count)
+		case "f8":
+			values, e = readConverted[T, float64](array.Data, order, count)
+		}
+	}
+	if e != nil {
+		values = nil
+		e = Errorf(RCErrDripPayload, "Unable to decode the array data: %v", e)
+	}
+	return
+}
+
+// AsNDArray converts a decoded payload element, such as a message's Payload, to an NDArray.
+// The data may be a byte string, as from a binary codec, or base64 text, as from JSON.
+func AsNDArray(element interface{}) (array NDArray, e error) {
+	if direct, isArray := element.(NDArray); isArray {
+		array = direct
+		return
+	}
+	elements, isMap := stringMap(element)
+	if isMap == false {
+		e = Errorf(RCErrDripPayload, "Expected an array, got %T", element)
+		return
+	}
+
+	dtype, isString := stringValue(elements["dtype"])
+	if isString == false {
+		e = Errorf(RCErrDripPayload, "Array dtype should be a string, got %T", elements["dtype"])
+		return
+	}
+	array.DType = dtype
+
+	shapeList, isList := elements["shape"].([]interface{})
+	if isList == false {
+		e = Errorf(RCErrDripPayload, "Array shape should be a list, got %T", elements["shape"])
+		return
+	}
+	array.Shape = make([]int, len(shapeList))
+	for i, dimension := range shapeList {
+		size, convErr := ConvertToMsgCode(dimension)
+		if convErr != nil {
+			e = Errorf(RCErrDripPayload, "Invalid array shape: %v", convErr)
+			return
+		}
+		array.Shape[i] = int(size)
+	}
+
+	switch data := elements["data"].(type) {
+	case []byte:
+		array.Data = data
+	case string:
+		if array.Data, e = base64.StdEncoding.DecodeString(data); e != nil {
+			e = Errorf(RCErrDripPayload, "Array data is not valid base64: %v", e)
+		}
+	default:
+		e = Errorf(RCErrDripPayload, "Array data should be bytes or base64 text, got %T", data)
+	}
+	return
+}
+
+// numericKind gives the numpy kind character and the size in bytes of a numeric type.
+func numericKind[T Numeric]() (kind byte, size int) {
+	var zero T
+	t := reflect.TypeOf(zero)
+	size = int(t.Size())
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		kind = 'f'
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		kind = 'u'
+	default:
+		kind = 'i'
+	}
+	return
+}
+
+// parseDType interprets a numpy type string, such as "<f8", for the numeric types of an NDArray.
+func parseDType(dtype string) (kind byte, size int, order binary.ByteOrder, e error) {
+	if len(dtype) < 3 {
+		e = Errorf(RCErrDripPayload, "Unsupported array dtype <%s>", dtype)
+		return
+	}
+	switch dtype[0] {
+	case '<', '|':
+		order = binary.LittleEndian
+	case '>':
+		order = binary.BigEndian
+	case '=':
+		order = binary.NativeEndian
+	default:
+		e = Errorf(RCErrDripPayload, "Unsupported byte order in array dtype <%s>", dtype)
+		return
+	}
+	kind = dtype[1]
+	size, convErr := strconv.Atoi(dtype[2:])
+	supported := convErr == nil && (size == 1 || size == 2 || size == 4 || size == 8)
+	switch kind {
+	case 'i', 'u':
+	case 'f':
+		supported = supported && size >= 4
+	default:
+		supported = false
+	}
+	if supported == false {
+		e = Errorf(RCErrDripPayload, "Unsupported array dtype <%s>", dtype)
+	}
+	return
+}
+
+func shapeSize(shape []int) (count int) {
+	count = 1
+	for _, dimension := range shape {
+		count *= dimension
+	}
+	return
+}
+
+// readConverted reads count values of type S and converts them to type T.
+func readConverted[T Numeric, S Numeric](data []byte, order binary.ByteOrder, count int) (values []T, e error) {
+	source := make([]S, count)
+	if e = binary.Read(bytes.NewReader(data), order, source); e != nil {
+		return
+	}
+	values = make([]T, count)
+	for i, value := range source {
+		values[i] = T(value)
+	}
+	return
+}
+
+// CodecEncodeSelf writes the array as a map, with the data as a byte string.
+func (array *NDArray) CodecEncodeSelf(encoder *codec.Encoder) {
+	encoder.MustEncode(map[string]interface{} {
+		"dtype": array.DType,
+		"shape": array.Shape,
+		"data":  array.Data,
+	})
+	return
+}
+
+// CodecDecodeSelf reads the array as AsNDArray does, so that DecodePayload recognizes base64 text data, as from JSON,
+// in an NDArray nested anywhere in the payload.
+func (array *NDArray) CodecDecodeSelf(decoder *codec.Decoder) {
+	var element interface{}
+	decoder.MustDecode(&element)
+	decoded, e := AsNDArray(normalizePayload(element))
+	if e != nil {
+		panic(e)
+	}
+	*array = decoded
+	return
+}
+
+func (array NDArray) String() string {
+	return fmt.Sprintf("NDArray(%s, shape=%v, %d bytes)", array.DType, array.Shape, len(array.Data))
+}
@@ -0,0 +1,78 @@
+/*
+* ndarray_test.go
+*
+* Tests of NDArray payloads.
+ */
+
+package dripline
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// traceReading is a payload with arrays nested in it
+type traceReading struct {
+	Channel           string     `json:"channel"`
+	Trace             NDArray    `json:"trace"`
+	History           []NDArray  `json:"history"`
+}
+
+func TestNDArrayPayload(t *testing.T) {
+	trace, e := NewNDArray([]float64{1.5, -2.5, 3, 4}, 2, 2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	counts, e := NewNDArray([]uint16{1, 2, 65535})
+	if e != nil {
+		t.Fatal(e)
+	}
+	sent := traceReading{Channel: "ch1", Trace: trace, History: []NDArray{counts, trace}}
+
+	for _, encoding := range testEncodings {
+		for _, payload := range []interface{}{sent, trace} {
+			alert := PrepareAlert("sensor.trace", encoding, SenderInfo{})
+			alert.Payload = payload
+			delivery, e := deliveryOf(&alert, WireV1)
+			if e != nil {
+				t.Fatalf("%s: %v", encoding, e)
+			}
+			var received Alert
+			if e = DecodeAndHandle(&delivery, nil, nil, func(a Alert) { received = a }, nil); e != nil {
+				t.Fatalf("%s: %v", encoding, e)
+			}
+
+			var decoded interface{}
+			if _, isReading := payload.(traceReading); isReading {
+				var reading traceReading
+				e = received.DecodePayload(&reading)
+				decoded = reading
+			} else {
+				var array NDArray
+				e = received.DecodePayload(&array)
+				decoded = array
+			}
+			if e != nil {
+				t.Fatalf("%s: %v", encoding, e)
+			}
+			if reflect.DeepEqual(decoded, payload) == false {
+				t.Errorf("%s: decoded payload is %v, expected %v", encoding, decoded, payload)
+			}
+		}
+	}
+
+	values, e := NDArrayValues[float32](trace)
+	if e != nil || reflect.DeepEqual(values, []float32{1.5, -2.5, 3, 4}) == false {
+		t.Errorf("Array values converted to float32 are %v, error %v", values, e)
+	}
+
+	message := Message{Payload: map[string]interface{} {
+		"channel": "ch1",
+		"trace":   map[string]interface{}{"dtype": "<f8", "shape": []interface{}{1.}, "data": "not base64!"},
+	}}
+	var reading traceReading
+	if e = message.DecodePayload(&reading); errors.Is(e, ErrDripPayload) == false {
+		t.Errorf("Array with invalid base64 data gave %v", e)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+* overflow_test.go
+*
+* Tests of the overflow policies for full receiver channels, over the memory broker.
+ */
+
+package dripline
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// relayEndpoint answers a get with the reply of the "echo" endpoint, which it requests through its own service.
+type relayEndpoint struct {
+	EndpointBase
+	service           *AmqpService
+}
+
+func (endpoint relayEndpoint) OnGet(request Request) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+	defer cancel()
+	value, e := Call[float64, float64](ctx, endpoint.service, "echo", MOGet, 2.5)
+	return value, e
+}
+
+// TestMemoryOverflowBlockReplies fills the endpoint channel of a service with the OverflowBlock policy, while its endpoint
+// waits for the reply to a request of its own; the reply must be routed while the service waits for room in the channel.
+func TestMemoryOverflowBlockReplies(t *testing.T) {
+	broker, client := newEchoService(t, 0)
+	sizes := DefaultBufferSizes
+	sizes.EndpointRequests = 1
+	relay := newSizedTestService(t, broker, "relay", sizes, func(service *AmqpService) {
+		service.Overflow = OverflowBlock
+	})
+	if e := relay.AddEndpoint("relay", relayEndpoint{service: relay}); e != nil {
+		t.Fatal(e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	var wait sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if value, e := Call[float64, float64](ctx, client, "relay", MOGet, 0); e != nil || value != 2.5 {
+				t.Errorf("Relayed request gave %v and error %v", value, e)
+			}
+		}()
+	}
+	wait.Wait()
+}
+
+// receiveBacklog takes the alerts waiting in a service's channel, and those that arrive until none has arrived for a while.
+func receiveBacklog(service *AmqpService) (payloads []interface{}) {
+	for {
+		select {
+		case alert := <-service.Receiver.AlertChan:
+			payloads = append(payloads, alert.Payload)
+		case <-time.After(200 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestMemoryOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   OverflowPolicy
+		received []interface{}
+	}{
+		{"block", OverflowBlock, []interface{}{0., 1., 2., 3., 4.}},
+		{"drop oldest", OverflowDropOldest, []interface{}{3., 4.}},
+		{"reject", OverflowReject, []interface{}{0., 1.}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := NewMemoryBroker()
+			sizes := DefaultBufferSizes
+			sizes.Alerts = 2
+			listener := newSizedTestService(t, broker, "listener", sizes, func(service *AmqpService) {
+				service.Overflow = test.policy
+			})
+			if e := listener.SubscribeToAlerts("sensor.#"); e != nil {
+				t.Fatal(e)
+			}
+			transport := broker.NewTransport()
+			if e := transport.Dial(""); e != nil {
+				t.Fatal(e)
+			}
+			defer transport.Close()
+
+			for i := 0; i < 5; i++ {
+				publishAlert(t, transport, "sensor.a", float64(i))
+			}
+			// let the service take in the alerts before any room is made in the channel
+			time.Sleep(100 * time.Millisecond)
+			if received := receiveBacklog(listener); reflect.DeepEqual(received, test.received) == false {
+				t.Errorf("Received alerts %v, expected %v", received, test.received)
+			}
+		})
+	}
+}
+
+// TestMemoryOverflowRejectRequest checks that a request that does not fit in the request channel is answered with ErrServiceBusy.
+func TestMemoryOverflowRejectRequest(t *testing.T) {
+	broker := NewMemoryBroker()
+	sizes := DefaultBufferSizes
+	sizes.Requests = 1
+	server := newSizedTestService(t, broker, "server", sizes, func(service *AmqpService) {
+		service.Overflow = OverflowReject
+	})
+	if e := server.SubscribeToRequests("server.#"); e != nil {
+		t.Fatal(e)
+	}
+	client := newTestService(t, broker, "")
+
+	// the first request fills the channel, which nothing reads
+	if _, e := client.SendRequest(PrepareRequest("server.first", "application/json", MOGet, SenderInfo{}), time.Second); e != nil {
+		t.Fatal(e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	reply, e := client.SendRequestContext(ctx, PrepareRequest("server.second", "application/json", MOGet, SenderInfo{}))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if reply.RetCode != RetCodeOf(ErrServiceBusy) || reply.ReturnMessage != ErrServiceBusy.Error() {
+		t.Errorf("Request to a busy service got RetCode %d and message %q", reply.RetCode, reply.ReturnMessage)
+	}
+	if request := <-server.Receiver.RequestChan; request.Target != "server.first" {
+		t.Errorf("Request channel holds the request to <%s>, expected <server.first>", request.Target)
+	}
+}
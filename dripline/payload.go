@@ -0,0 +1,91 @@
+/*
+* payload.go
+*
+* Conversion between message payloads and Go values.
+*
+* A decoded payload is a tree of generic maps, slices, and scalars whose exact types depend on the codec that decoded it.
+* The functions here bind such a tree to a user type, and convert a user type into a tree that every codec can encode.
+ */
+
+package dripline
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/ugorji/go/codec"
+)
+
+// payloadHandle is used to convert payloads to and from Go values.
+// Struct fields are matched by their `codec` tag, or their `json` tag if there is no `codec` tag.
+var payloadHandle = newPayloadHandle()
+
+func newPayloadHandle() (handle *codec.MsgpackHandle) {
+	handle = new(codec.MsgpackHandle)
+	// strings are written as text and byte slices as binary, and each is read back as written
+	handle.WriteExt = true
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return
+}
+
+// DecodePayload stores the message's payload in the value pointed to by v, which is typically a pointer to a struct.
+// Struct fields are matched by their `codec` or `json` tags; payload maps from any codec are accepted.
+// A payload that does not fit v is reported as an RCErrDripPayload error.
+func (message *Message) DecodePayload(v interface{}) (e error) {
+	var encoded []byte
+	if e = codec.NewEncoderBytes(&encoded, payloadHandle).Encode(normalizePayload((*message).Payload)); e != nil {
+		e = Errorf(RCErrDripPayload, "Unable to read the payload: %v", e)
+		return
+	}
+	if e = codec.NewDecoderBytes(encoded, payloadHandle).Decode(v); e != nil {
+		e = Errorf(RCErrDripPayload, "Payload does not match the expected type: %v", e)
+	}
+	return
+}
+
+// SetPayload sets the message's payload from a Go value, such as a struct with `codec` or `json` tags.
+// The value is converted into generic maps and slices, so the message can be encoded by any codec.
+func (message *Message) SetPayload(v interface{}) (e error) {
+	var encoded []byte
+	if e = codec.NewEncoderBytes(&encoded, payloadHandle).Encode(v); e != nil {
+		e = Errorf(RCErrDripPayload, "Unable to convert the payload: %v", e)
+		return
+	}
+	var payload interface{}
+	if e = codec.NewDecoderBytes(encoded, payloadHandle).Decode(&payload); e != nil {
+		e = Errorf(RCErrDripPayload, "Unable to convert the payload: %v", e)
+		return
+	}
+	(*message).Payload = payload
+	return
+}
+
+// normalizePayload converts maps with interface{} keys, as produced by msgpack and CBOR decoding, into maps with string keys.
+func normalizePayload(payload interface{}) interface{} {
+	switch val := payload.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(val))
+		for keyIfc, elem := range val {
+			key, isString := stringValue(keyIfc)
+			if isString == false {
+				key = fmt.Sprint(keyIfc)
+			}
+			normalized[key] = normalizePayload(elem)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(val))
+		for key, elem := range val {
+			normalized[key] = normalizePayload(elem)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(val))
+		for i, elem := range val {
+			normalized[i] = normalizePayload(elem)
+		}
+		return normalized
+	default:
+		return payload
+	}
+}
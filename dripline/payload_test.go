@@ -0,0 +1,130 @@
+/*
+* payload_test.go
+*
+* Tests of the conversion between message payloads and Go values.
+ */
+
+package dripline
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// jsonSetting is a payload type with `json` tags
+type jsonSetting struct {
+	Channel           string             `json:"channel"`
+	Voltage           float64            `json:"voltage"`
+	Limits            []int              `json:"limits"`
+	Range             jsonRange          `json:"range"`
+}
+
+type jsonRange struct {
+	Low               float64            `json:"low"`
+	High              float64            `json:"high"`
+}
+
+// codecSetting is a payload type with `codec` tags, which take precedence over `json` tags
+type codecSetting struct {
+	Channel           string             `codec:"channel"`
+	Voltage           float64            `codec:"voltage" json:"volts"`
+	Limits            []int              `codec:"limits"`
+	Range             map[string]float64 `codec:"range"`
+}
+
+// decodedSetting gives the payload of a setting as each codec decodes it: JSON gives maps with string keys and float64 numbers,
+// while msgpack and CBOR give maps with interface{} keys and integer types, and msgpack may give strings as raw bytes.
+func decodedSetting(encoding string) (payload interface{}) {
+	switch encoding {
+	case "application/msgpack":
+		payload = map[interface{}]interface{} {
+			"channel": []byte("ch1"),
+			"voltage": 12.5,
+			"limits":  []interface{}{int64(-1), uint64(10)},
+			"range":   map[interface{}]interface{}{"low": int64(-2), "high": float32(12.5)},
+		}
+	case "application/cbor":
+		payload = map[interface{}]interface{} {
+			"channel": "ch1",
+			"voltage": 12.5,
+			"limits":  []interface{}{int64(-1), uint64(10)},
+			"range":   map[interface{}]interface{}{"low": int64(-2), "high": 12.5},
+		}
+	default:
+		payload = map[string]interface{} {
+			"channel": "ch1",
+			"voltage": 12.5,
+			"limits":  []interface{}{-1., 10.},
+			"range":   map[string]interface{}{"low": -2., "high": 12.5},
+		}
+	}
+	return
+}
+
+func TestDecodePayload(t *testing.T) {
+	expectedJson := jsonSetting{Channel: "ch1", Voltage: 12.5, Limits: []int{-1, 10}, Range: jsonRange{Low: -2, High: 12.5}}
+	expectedCodec := codecSetting{Channel: "ch1", Voltage: 12.5, Limits: []int{-1, 10}, Range: map[string]float64{"low": -2, "high": 12.5}}
+	for _, encoding := range testEncodings {
+		message := Message{Payload: decodedSetting(encoding)}
+
+		var fromJson jsonSetting
+		if e := message.DecodePayload(&fromJson); e != nil || reflect.DeepEqual(fromJson, expectedJson) == false {
+			t.Errorf("%s: payload decoded with json tags to %+v, error %v", encoding, fromJson, e)
+		}
+		var fromCodec codecSetting
+		if e := message.DecodePayload(&fromCodec); e != nil || reflect.DeepEqual(fromCodec, expectedCodec) == false {
+			t.Errorf("%s: payload decoded with codec tags to %+v, error %v", encoding, fromCodec, e)
+		}
+	}
+
+	message := Message{Payload: map[interface{}]interface{}{"voltage": "high"}}
+	var setting jsonSetting
+	if e := message.DecodePayload(&setting); errors.Is(e, ErrDripPayload) == false {
+		t.Errorf("Payload of the wrong type gave %v", e)
+	}
+}
+
+func TestSetPayload(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     interface{}
+	}{
+		{"json tags", jsonSetting{Channel: "ch1", Voltage: 12.5, Limits: []int{-1, 10}, Range: jsonRange{Low: -2, High: 12.5}}},
+		{"codec tags", codecSetting{Channel: "ch1", Voltage: 12.5, Limits: []int{-1, 10}, Range: map[string]float64{"low": -2, "high": 12.5}}},
+	}
+	for _, test := range tests {
+		var message Message
+		if e := message.SetPayload(test.value); e != nil {
+			t.Fatalf("%s: %v", test.name, e)
+		}
+		payload, isMap := message.Payload.(map[string]interface{})
+		if isMap == false {
+			t.Fatalf("%s: payload is a %T, expected a map with string keys", test.name, message.Payload)
+		}
+		if payload["channel"] != "ch1" || payload["voltage"] != 12.5 {
+			t.Errorf("%s: payload has channel %#v and voltage %#v", test.name, payload["channel"], payload["voltage"])
+		}
+		if _, isMap = payload["range"].(map[string]interface{}); isMap == false {
+			t.Errorf("%s: nested payload is a %T, expected a map with string keys", test.name, payload["range"])
+		}
+
+		// the payload comes back as the same value through every codec
+		for _, encoding := range testEncodings {
+			alert := PrepareAlert("sensor.setting", encoding, SenderInfo{})
+			alert.Payload = message.Payload
+			delivery, e := deliveryOf(&alert, WireV1)
+			if e != nil {
+				t.Fatalf("%s, %s: %v", test.name, encoding, e)
+			}
+			var received Alert
+			if e = DecodeAndHandle(&delivery, nil, nil, func(a Alert) { received = a }, nil); e != nil {
+				t.Fatalf("%s, %s: %v", test.name, encoding, e)
+			}
+			decoded := reflect.New(reflect.TypeOf(test.value))
+			if e = received.DecodePayload(decoded.Interface()); e != nil || reflect.DeepEqual(decoded.Elem().Interface(), test.value) == false {
+				t.Errorf("%s, %s: payload decoded to %+v, error %v", test.name, encoding, decoded.Elem().Interface(), e)
+			}
+		}
+	}
+}
@@ -7,9 +7,13 @@
 package dripline
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/user"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/streadway/amqp"
@@ -24,11 +28,13 @@ import (
 type AmqpReceiver struct {
 	QueueName         string
 	RequestChan      chan Request
-	//ReplyChan        chan Reply
+	ReplyChan        chan Reply
 	AlertChan        chan Alert
 	InfoChan         chan Info
 	subscriptionCount int
 	messageQueue      <-chan amqp.Delivery
+	replyQueueName    atomic.Value
+	replyQueue        <-chan amqp.Delivery
 }
 
 type AmqpSender struct {
@@ -42,15 +48,130 @@ type AmqpSender struct {
 }
 
 
+// ReconnectPolicy controls how the service (re)connects to the broker.
+// The wait between attempts starts at InitialInterval and is multiplied by Multiplier after each failure, up to MaxInterval.
+// With a non-positive MaxAttempts the service keeps trying until it is stopped.
+// The first connection, made by StartService, is limited to InitialAttempts instead, so that a service whose broker
+// cannot be reached does not start; with a non-positive InitialAttempts, MaxAttempts applies to it as well.
+type ReconnectPolicy struct {
+	InitialInterval   time.Duration
+	MaxInterval       time.Duration
+	Multiplier        float64
+	MaxAttempts       int
+	InitialAttempts   int
+}
+
+// OfflinePolicy determines what happens to outgoing messages that are submitted while the service is not connected to the broker.
+type OfflinePolicy int
+
+const (
+	// OfflineHold keeps messages in the send buffers until the connection is restored; submission fails once a buffer is full.
+	OfflineHold OfflinePolicy = iota
+	// OfflineReject refuses messages while the service is disconnected.
+	OfflineReject
+)
+
+// OverflowPolicy determines what happens to a received message when the channel that it is meant for is full.
+// Dropped requests are answered with ErrServiceBusy, if they ask for a reply.  In the AckManual mode, dropped messages are rejected,
+// so they are dead-lettered if the service has a dead-letter exchange.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room in the channel; meanwhile the service stops taking in messages, but keeps sending them and taking in replies.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest message in the channel to make room.
+	OverflowDropOldest
+	// OverflowReject drops the new message.
+	OverflowReject
+)
+
+// BufferSizes are the capacities of a service's message channels.
+type BufferSizes struct {
+	// Receiver channels
+	Requests          int
+	Replies           int
+	Alerts            int
+	Infos             int
+	// Send buffers
+	SendRequests      int
+	SendReplies       int
+	SendAlerts        int
+	SendInfos         int
+	// EndpointRequests holds the requests waiting to be handled by registered endpoints
+	EndpointRequests  int
+}
+
+// DefaultBufferSizes are the buffer sizes used by ServiceDefaults.
+var DefaultBufferSizes = BufferSizes {
+	Requests:         100,
+	Replies:          100,
+	Alerts:           100,
+	Infos:            100,
+	SendRequests:     100,
+	SendReplies:      100,
+	SendAlerts:       100,
+	SendInfos:        100,
+	EndpointRequests: 100,
+}
+
+// expiredReplyMemory is how long the correlation IDs of requests that stopped waiting are remembered, so that late replies to them are dropped.
+const expiredReplyMemory = 10 * time.Minute
+
+type subscription struct {
+	exchange          string
+	routingKey        string
+}
+
+// expiredRequest is a request that stopped waiting for its reply at the given time.
+type expiredRequest struct {
+	corrId            string
+	expired           time.Time
+}
+
 type AmqpService struct {
 	BrokerAddress     string
+	Encoding          string
+	WireVersion       WireVersion
+	Compression       string
+	CompressionThreshold int
+	Chunking          ChunkPolicy
+	// Connected reports whether StartService connected to the broker; it is not updated afterwards.
+	// Deprecated: use IsConnected for the current state of the connection.
 	Connected         bool
+	connected         atomic.Bool
 	DoneSignal        chan bool
 	Receiver          AmqpReceiver
 	Sender            AmqpSender
-	channel           *amqp.Channel
-	connection        *amqp.Connection
+	Reconnect         ReconnectPolicy
+	Offline           OfflinePolicy
+	LockTimeout       time.Duration
+	AckMode           AckMode
+	MaxRedeliveries   int
+	DeadLetter        DeadLetterPolicy
+	Prefetch          int
+	Overflow          OverflowPolicy
+	Transport         Transport
+	transportClosed   <-chan *amqp.Error
+	subscriptions     []subscription
+	subscriptionLock  sync.Mutex
+	consumeLock       sync.Mutex
+	pendingReplies    map[string]chan Reply
+	expiredRequests   []expiredRequest
+	expiredIds        map[string]time.Time
+	pendingLock       sync.Mutex
+	endpoints         map[string]Endpoint
+	endpointLock      sync.Mutex
+	endpointRequests  chan endpointRequest
+	lockoutEnabled    bool
+	lockoutKey        string
+	lockoutExpiry     time.Time
+	lockoutLock       sync.Mutex
+	chunks            *chunkAssembler
+	replyChunks       *chunkAssembler
+	redeliveries      map[string]int
+	redeliveryLock    sync.Mutex
 	stopQueue         chan bool
+	stopped           chan struct{}
 	senderInfo        SenderInfo
 }
 
@@ -61,30 +182,68 @@ type AmqpService struct {
 
 // ServiceDefaults sets up a Service struct with the default values
 func ServiceDefaults() (service *AmqpService) {
+	service = ServiceWithBufferSizes(DefaultBufferSizes)
+	return
+}
+
+// ServiceWithBufferSizes sets up a Service struct with the default values, and message channels of the given sizes
+func ServiceWithBufferSizes(sizes BufferSizes) (service *AmqpService) {
 	var newService = AmqpService {
 		BrokerAddress: "localhost",
+		Encoding:      DefaultEncoding,
+		WireVersion:   WireV1,
+		Compression:   "",
+		CompressionThreshold: DefaultCompressionThreshold,
+		Chunking:      ChunkPolicy {
+			Size:           0,
+			Timeout:        30 * time.Second,
+			MaxMessageSize: 64 * 1024 * 1024,
+			MaxPendingSize: 256 * 1024 * 1024,
+		},
 		Connected: false,
 		DoneSignal:    make(chan bool, 1),
 		Receiver:      AmqpReceiver {
 			QueueName: "my_queue",
-			RequestChan:    make(chan Request, 100),
-			//ReplyChan:      make(chan Reply, 100),
-			AlertChan:      make(chan Alert, 100),
-			InfoChan:       make(chan Info, 100),
+			RequestChan:    make(chan Request, sizes.Requests),
+			ReplyChan:      make(chan Reply, sizes.Replies),
+			AlertChan:      make(chan Alert, sizes.Alerts),
+			InfoChan:       make(chan Info, sizes.Infos),
 		},
 		Sender:        AmqpSender {
 			RequestExchangeName: "requests",
 			AlertExchangeName:   "alerts",
 			InfoExchangeName:    "requests",
-			requestChan:    make(chan Request, 100),
-			replyChan:      make(chan Reply, 100),
-			alertChan:      make(chan Alert, 100),
-			infoChan:       make(chan Info, 100),
+			requestChan:    make(chan Request, sizes.SendRequests),
+			replyChan:      make(chan Reply, sizes.SendReplies),
+			alertChan:      make(chan Alert, sizes.SendAlerts),
+			infoChan:       make(chan Info, sizes.SendInfos),
 		},
+		Reconnect:     ReconnectPolicy {
+			InitialInterval: time.Second,
+			MaxInterval:     time.Minute,
+			Multiplier:      2.,
+			MaxAttempts:     0,
+			InitialAttempts: 2,
+		},
+		Offline:       OfflineHold,
+		AckMode:       AckOnReceipt,
+		MaxRedeliveries: 5,
+		DeadLetter:    DeadLetterPolicy{},
+		Prefetch:      0,
+		Overflow:      OverflowBlock,
+		Transport:     NewAmqpTransport(),
+		pendingReplies: make(map[string]chan Reply),
+		expiredIds:    make(map[string]time.Time),
+		endpoints:     make(map[string]Endpoint),
+		endpointRequests: make(chan endpointRequest, sizes.EndpointRequests),
+		replyChunks:   newChunkAssembler(nil),
+		redeliveries:  make(map[string]int),
 		stopQueue:     make(chan bool, 5),
+		stopped:       make(chan struct{}),
 	}
 
 	service = &newService
+	service.chunks = newChunkAssembler(service.settleDeliveries)
 	return
 }
 
@@ -117,126 +276,333 @@ func StartService(brokerAddress, queueName string) (service *AmqpService) {
 //*** Send-Message Functions ***
 //******************************
 
-// SendRequest sends a Request message.  It creates a reply queue, begins consuming on it, and returns the channel on which the client can wait for the Reply message.
-// The request will timeout after a duration of replyTimeout.  Supply a non-positive duration to run with no timeout.
-func (service *AmqpService) SendRequest(toSend Request, replyTimeout time.Duration) (replyChan <-chan Reply, e error) {
-	logging.Log.Debug("Submitting request to send")
+// ErrReplyTimeout is returned when the deadline for a request passes before its reply arrives.
+// It matches ErrDripTimeout with errors.Is.
+var ErrReplyTimeout = NewError(RCErrDripTimeout, "Timeout while waiting for reply")
 
-	// First we create a new channel, create the reply queue on that channel, and start consuming
-	replyChannel, chanErr := service.connection.Channel()
-	if chanErr != nil {
-		logging.Log.Criticalf("Unable to get the reply channel:\n\t%v", chanErr.Error())
-		service.DoneSignal <- true
+// replyWaiter receives the reply to a single outgoing request from the service's shared reply queue.
+type replyWaiter struct {
+	service           *AmqpService
+	request           Request
+	replies           chan Reply
+}
+
+// SendRequestContext sends a Request message and waits for the Reply.
+// Waiting ends when the reply arrives or when ctx is done; either way the request stops listening for its correlation ID before returning.
+// If the deadline of ctx passes, the error is ErrReplyTimeout; if ctx is canceled, it is ctx.Err().
+func (service *AmqpService) SendRequestContext(ctx context.Context, toSend Request) (reply Reply, e error) {
+	waiter, e := service.submitRequest(ctx, toSend)
+	if e != nil {
 		return
 	}
-	logging.Log.Debug("Channel with AMQP broker established")
+	reply, e = waiter.wait(ctx)
+	return
+}
 
-	replyQueue, declareErr := replyChannel.QueueDeclare("", false, true, true, false, nil)
-	if declareErr != nil {
-		logging.Log.Errorf("Unable to declare the reply queue: %v", declareErr)
-		e = declareErr
-		return
+// SendRequestSync sends a Request message and blocks until the Reply arrives.
+// If replyTimeout is positive and no reply arrives within that time, ErrReplyTimeout is returned.
+func (service *AmqpService) SendRequestSync(toSend Request, replyTimeout time.Duration) (reply Reply, e error) {
+	ctx := context.Background()
+	if replyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, replyTimeout)
+		defer cancel()
 	}
-	queueName := replyQueue.Name
+	reply, e = service.SendRequestContext(ctx, toSend)
+	return
+}
 
-	toSend.ReplyTo = queueName
-	bindErr := replyChannel.QueueBind(queueName, queueName, service.Sender.RequestExchangeName, false, nil)
-	if bindErr != nil {
-		logging.Log.Errorf("Unable to bind the reply queue <%s>:\n\t%v", queueName, bindErr)
-		e = bindErr
-		return
+// SendRequest sends a Request message and returns the channel on which the client can wait for the Reply message.
+// The request will timeout after a duration of replyTimeout, in which case a Reply with RCErrDripTimeout is delivered.  Supply a non-positive duration to run with no timeout.
+// New code should prefer SendRequestContext, which reports timeouts and failures as errors.
+func (service *AmqpService) SendRequest(toSend Request, replyTimeout time.Duration) (replyChan <-chan Reply, e error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if replyTimeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), replyTimeout)
 	}
 
-	amqpReplyChan, consumeErr := replyChannel.Consume(queueName, "", false, true, true, false, nil)
-	if consumeErr != nil {
-		logging.Log.Errorf("Unable start consuming from reply queue <%s>:\n\t%v", queueName, consumeErr.Error())
-		e = consumeErr
+	waiter, e := service.submitRequest(ctx, toSend)
+	if e != nil {
+		cancel()
 		return
 	}
 
-	// Send the request
-	service.Sender.requestChan <- toSend
-	logging.Log.Debug("Request sent")
-
 	replyChanFull := make(chan Reply, 1)
 
 	// In a concurrent function, we'll wait to receive the reply
-	// After the reply is received (or the receive timed out), the reply channel will be closed, which should clean up everything nicely
 	go func() {
-		var amqpMessage amqp.Delivery
-		messageReceived := false
-
-		if replyTimeout <= 0 {
-			// Wait for a message with no timeout
-			amqpMessage = <-amqpReplyChan
-			messageReceived = true
-		} else {
-			// Wait for message with a timeout
-			select {
-			case amqpMessage = <-amqpReplyChan:
-				messageReceived = true
-				break
-			case <-time.After(replyTimeout):
-				logging.Log.Warning("Timed out waiting for reply")
-				replyChanFull <- PrepareReplyToRequest(toSend, RCErrDripTimeout, "Timeout while waiting for reply", service.senderInfo)
-				break
-			}
+		defer cancel()
+		reply, waitErr := waiter.wait(ctx)
+		switch {
+		case waitErr == ErrReplyTimeout:
+			logging.Log.Warning("Timed out waiting for reply")
+			reply = PrepareReplyToRequest(waiter.request, RCErrDripTimeout, waitErr.Error(), service.senderInfo)
+		case waitErr != nil:
+			logging.Log.Errorf("Unable to receive the reply:\n\t%v", waitErr)
+			reply = PrepareReplyToRequest(waiter.request, RCErrAMQP, waitErr.Error(), service.senderInfo)
 		}
+		replyChanFull <- reply
+		return
+	}()
+
+	replyChan = replyChanFull
+	return
+}
 
-		if messageReceived {
-			// Send an acknowledgement to the broker
-			amqpMessage.Ack(false)
+// submitRequest registers the request to receive its reply by correlation ID and hands it to the AMQP loop to be sent.
+// All requests share the service's reply queue.
+func (service *AmqpService) submitRequest(ctx context.Context, toSend Request) (waiter *replyWaiter, e error) {
+	logging.Log.Debug("Submitting request to send")
 
-			// Decode and handle the message -- only replies are expected
-			decodeErr := DecodeAndHandle(&amqpMessage,
-				func(request Request){
-					logging.Log.Error("Unexpected request received while waiting for a reply")
-				},
-				func(reply Reply){
-					replyChanFull <- reply
-				},
-				func(alert Alert){
-					logging.Log.Error("Unexpected alert received while waiting for a reply")
-				},
-				func(info Info){
-					logging.Log.Error("Unexpected info received while waiting for a reply")
-				},
-			)
-			if decodeErr != nil {
-				logging.Log.Errorf("An error occurred while decoding a message: \n\t%v", decodeErr)
-				return
-			}
+	select {
+	case <-service.stopped:
+		e = ErrServiceStopped
+		return
+	default:
+	}
+	if service.IsConnected() == false {
+		e = ErrNotConnected
+		return
+	}
+
+	if toSend.CorrId == "" {
+		toSend.CorrId = uuid.New()
+	}
+	toSend.ReplyTo = service.replyQueueName()
+
+	waiter = &replyWaiter {
+		service:    service,
+		request:    toSend,
+		replies:    make(chan Reply, 1),
+	}
+	service.pendingLock.Lock()
+	service.pendingReplies[toSend.CorrId] = waiter.replies
+	service.pendingLock.Unlock()
+
+	// Send the request
+	select {
+	case service.Sender.requestChan <- toSend:
+	case <-ctx.Done():
+		service.removePending(toSend.CorrId)
+		waiter = nil
+		e = contextError(ctx)
+		return
+	case <-service.stopped:
+		service.removePending(toSend.CorrId)
+		waiter = nil
+		e = ErrServiceStopped
+		return
+	}
+	logging.Log.Debug("Request sent")
+	return
+}
+
+// wait blocks until the reply arrives or ctx is done.
+func (waiter *replyWaiter) wait(ctx context.Context) (reply Reply, e error) {
+	defer waiter.service.removePending(waiter.request.CorrId)
+
+	select {
+	case <-ctx.Done():
+		e = contextError(ctx)
+		waiter.service.expirePending(waiter.request.CorrId)
+	case r, chanOpen := <-waiter.replies:
+		if ! chanOpen {
+			e = fmt.Errorf("Connection to the broker was lost before a reply was received")
+			return
 		}
+		reply = r
+	}
+	return
+}
 
-		logging.Log.Debug("Closing the reply channel")
-		if err := replyChannel.Close(); err != nil {
-			logging.Log.Errorf("Error while closing reply queue:\n\t%v", err)
+// removePending stops waiting for a reply with the given correlation ID.
+func (service *AmqpService) removePending(corrId string) {
+	service.pendingLock.Lock()
+	delete(service.pendingReplies, corrId)
+	service.pendingLock.Unlock()
+	return
+}
+
+// expirePending stops waiting for a reply with the given correlation ID, and remembers the ID so that a late reply is dropped.
+// IDs are forgotten after expiredReplyMemory.
+func (service *AmqpService) expirePending(corrId string) {
+	now := time.Now()
+	service.pendingLock.Lock()
+	defer service.pendingLock.Unlock()
+	delete(service.pendingReplies, corrId)
+	for len(service.expiredRequests) > 0 && now.Sub(service.expiredRequests[0].expired) > expiredReplyMemory {
+		oldest := service.expiredRequests[0]
+		// the ID may have expired again since, in which case it is remembered from then
+		if service.expiredIds[oldest.corrId] == oldest.expired {
+			delete(service.expiredIds, oldest.corrId)
 		}
+		service.expiredRequests = service.expiredRequests[1:]
+	}
+	service.expiredRequests = append(service.expiredRequests, expiredRequest{corrId: corrId, expired: now})
+	service.expiredIds[corrId] = now
+	return
+}
 
+// routeReply hands a reply to the request waiting on its correlation ID.
+// Late replies to this service's requests that stopped waiting are dropped.
+// Other replies that nobody is waiting for go to Receiver.ReplyChan, and are dropped if that channel is full.
+func (service *AmqpService) routeReply(reply Reply) {
+	service.pendingLock.Lock()
+	replies, waiting := service.pendingReplies[reply.CorrId]
+	delete(service.pendingReplies, reply.CorrId)
+	_, expired := service.expiredIds[reply.CorrId]
+	service.pendingLock.Unlock()
+
+	if waiting {
+		replies <- reply
 		return
-	}()
+	}
+	if expired {
+		logging.Log.Debugf("Dropping a reply (corr. ID %s) that arrived after its request stopped waiting", reply.CorrId)
+		return
+	}
 
-	replyChan = replyChanFull
+	select {
+	case service.Receiver.ReplyChan <- reply:
+	default:
+		logging.Log.Warningf("Dropping a reply (corr. ID %s) because no request is waiting for it and the reply channel is full", reply.CorrId)
+	}
+	return
+}
+
+// failPending abandons all requests that are waiting for replies, which can no longer arrive once the reply queue is gone.
+func (service *AmqpService) failPending() {
+	service.pendingLock.Lock()
+	defer service.pendingLock.Unlock()
+	for corrId, replies := range service.pendingReplies {
+		close(replies)
+		delete(service.pendingReplies, corrId)
+	}
+	return
+}
+
+// contextError converts the error of a finished context, reporting an expired deadline as ErrReplyTimeout.
+func contextError(ctx context.Context) (e error) {
+	e = ctx.Err()
+	if e == context.DeadlineExceeded {
+		e = ErrReplyTimeout
+	}
+	return
+}
+
+// Errors from handing messages to the service to be sent
+var (
+	// ErrNotConnected is returned when a message cannot be sent because the service is not connected to a broker; it matches ErrAMQPConn.
+	ErrNotConnected = NewError(RCErrAMQPConn, "Service is not connected to a broker")
+	// ErrServiceStopped is returned when the service has been stopped, or stops before the message is sent.
+	ErrServiceStopped = errors.New("Service has been stopped")
+	// ErrSendBufferFull is returned when the service is disconnected and cannot hold any more messages until it reconnects.
+	ErrSendBufferFull = errors.New("Service is not connected and the send buffer is full")
+)
+
+// SendFuture is the eventual outcome of handing a message to the service to be sent.
+type SendFuture struct {
+	once              sync.Once
+	sent              chan error
+	stopped           <-chan struct{}
+	err               error
+}
+
+// Wait blocks until the message has been published, and returns the error from encoding or publishing it, if any.
+// If the service stops before sending the message, the error is ErrServiceStopped.
+// Wait may be called any number of times, and always returns the same error.
+func (future *SendFuture) Wait() error {
+	future.once.Do(func() {
+		if future.sent == nil {
+			return
+		}
+		select {
+		case future.err = <-future.sent:
+		case <-future.stopped:
+			select {
+			case future.err = <-future.sent:
+			default:
+				future.err = ErrServiceStopped
+			}
+		}
+	})
+	return future.err
+}
+
+// SendReply sends a Reply message, and waits until the broker has accepted it.
+// Errors from encoding or publishing the reply are returned; a reply to a requester whose queue is gone is an ErrAMQPRK error.
+// While the service is disconnected, the reply is held until the connection is restored, according to the OfflinePolicy.
+func (service *AmqpService) SendReply(toSend Reply) (e error) {
+	e = service.SendReplyAsync(toSend).Wait()
+	return
+}
+
+// SendReplyAsync hands a Reply message to the service to be sent, without waiting for the outcome.
+// It only blocks while the send buffer is full and the service is connected.
+func (service *AmqpService) SendReplyAsync(toSend Reply) (future *SendFuture) {
+	toSend.sent = make(chan error, 1)
+	future = queueSend(service, service.Sender.replyChan, toSend, toSend.sent)
+	return
+}
 
+// SendAlert sends an Alert message, and waits until the broker has accepted it.
+// As with SendReply, errors are returned; an alert that no queue is bound to receive is an ErrAMQPRK error.
+func (service *AmqpService) SendAlert(toSend Alert) (e error) {
+	e = service.SendAlertAsync(toSend).Wait()
 	return
 }
 
-// SendReply sends a Reply message.
-func (service *AmqpService) SendReply(toSend Reply) (error) {
-	service.Sender.replyChan <- toSend
-	return nil
+// SendAlertAsync hands an Alert message to the service to be sent, without waiting for the outcome.
+func (service *AmqpService) SendAlertAsync(toSend Alert) (future *SendFuture) {
+	toSend.sent = make(chan error, 1)
+	future = queueSend(service, service.Sender.alertChan, toSend, toSend.sent)
+	return
 }
 
-// SendAlert sends an Alert message.
-func (service *AmqpService) SendAlert(toSend Alert) (error) {
-	service.Sender.alertChan <- toSend
-	return nil
+// SendInfo sends an Info message, and waits until the broker has accepted it.
+// As with SendReply, errors are returned; an info is not required to reach a queue.
+func (service *AmqpService) SendInfo(toSend Info) (e error) {
+	e = service.SendInfoAsync(toSend).Wait()
+	return
 }
 
-// SendInfo sends an Info message.
-func (service *AmqpService) SendInfo(toSend Info) (error) {
-	service.Sender.infoChan <- toSend
-	return nil
+// SendInfoAsync hands an Info message to the service to be sent, without waiting for the outcome.
+func (service *AmqpService) SendInfoAsync(toSend Info) (future *SendFuture) {
+	toSend.sent = make(chan error, 1)
+	future = queueSend(service, service.Sender.infoChan, toSend, toSend.sent)
+	return
+}
+
+// queueSend puts a message in one of the send buffers, for the AMQP loop to send and report the outcome on sent.
+// While the service is connected, it waits for room in the buffer; while it is disconnected, a full buffer is an error.
+func queueSend[M any](service *AmqpService, buffer chan<- M, toSend M, sent chan error) (future *SendFuture) {
+	future = &SendFuture{sent: sent, stopped: service.stopped}
+	select {
+	case <-service.stopped:
+		future = &SendFuture{err: ErrServiceStopped}
+		return
+	default:
+	}
+	if offlineErr := service.checkOffline(); offlineErr != nil {
+		future = &SendFuture{err: offlineErr}
+		return
+	}
+
+	if service.IsConnected() {
+		select {
+		case buffer <- toSend:
+		case <-service.stopped:
+			future = &SendFuture{err: ErrServiceStopped}
+		}
+		return
+	}
+	select {
+	case buffer <- toSend:
+	default:
+		future = &SendFuture{err: ErrSendBufferFull}
+	}
+	return
 }
 
 // Stop interrupts and halts the AMQP service.
@@ -252,58 +618,69 @@ func (service *AmqpService) Stop() {
 
 // SubscribeToRequests binds the Requests exchange to the service's queue with the given routing key.
 func (service *AmqpService) SubscribeToRequests(routingKey string) (e error) {
-	if service.Connected == false {
+	if service.IsConnected() == false {
 		e = fmt.Errorf("Service is not connected to a broker")
 		return
 	}
-	if e = service.channel.QueueBind(service.Receiver.QueueName, routingKey, service.Sender.RequestExchangeName, false, nil); e != nil {
+	if e = service.Transport.QueueBind(service.Receiver.QueueName, routingKey, service.Sender.RequestExchangeName); e != nil {
+		return
+	}
+	service.addSubscription(service.Sender.RequestExchangeName, routingKey)
+	if e = service.beginConsuming(); e != nil {
 		return
 	}
-	service.Receiver.subscriptionCount++
-	service.beginConsuming()
 	logging.Log.Debugf("Subscription established: ex(%s) @ rk(%s) --> q(%s)", service.Sender.RequestExchangeName, routingKey, service.Receiver.QueueName)
 	return
 }
-/*
+
+// SubscribeToReplies binds the given exchange to the service's queue with the given routing key.
+// Replies received this way are routed to a waiting request with the same correlation ID, or otherwise to Receiver.ReplyChan.
 func (service *AmqpService) SubscribeToReplies(routingKey, exchange string) (e error) {
-	if service.Receiver.Connected == false {
+	if service.IsConnected() == false {
 		e = fmt.Errorf("Service is not connected to a broker")
 		return
 	}
-	if e = service.channel.QueueBind(service.Receiver.QueueName, routingKey, exchange, false, nil); e != nil {
+	if e = service.Transport.QueueBind(service.Receiver.QueueName, routingKey, exchange); e != nil {
+		return
+	}
+	service.addSubscription(exchange, routingKey)
+	if e = service.beginConsuming(); e != nil {
 		return
 	}
-	service.Receiver.subscriptionCount++
-	service.beginConsuming()
+	logging.Log.Debugf("Subscription established: ex(%s) @ rk(%s) --> q(%s)", exchange, routingKey, service.Receiver.QueueName)
 	return
 }
-*/
-// SubscribeToRequests binds the Alerts exchange to the service's queue with the given routing key.
+
+// SubscribeToAlerts binds the Alerts exchange to the service's queue with the given routing key.
 func (service *AmqpService) SubscribeToAlerts(routingKey string) (e error) {
-	if service.Connected == false {
+	if service.IsConnected() == false {
 		e = fmt.Errorf("Service is not connected to a broker")
 		return
 	}
-	if e = service.channel.QueueBind(service.Receiver.QueueName, routingKey, service.Sender.AlertExchangeName, false, nil); e != nil {
+	if e = service.Transport.QueueBind(service.Receiver.QueueName, routingKey, service.Sender.AlertExchangeName); e != nil {
+		return
+	}
+	service.addSubscription(service.Sender.AlertExchangeName, routingKey)
+	if e = service.beginConsuming(); e != nil {
 		return
 	}
-	service.Receiver.subscriptionCount++
-	service.beginConsuming()
 	logging.Log.Debugf("Subscription established: ex(%s) @ rk(%s) --> q(%s)", service.Sender.AlertExchangeName, routingKey, service.Receiver.QueueName)
 	return
 }
 
-// SubscribeToRequests binds the Infos exchange to the service's queue with the given routing key.
+// SubscribeToInfos binds the Infos exchange to the service's queue with the given routing key.
 func (service *AmqpService) SubscribeToInfos(routingKey string) (e error) {
-	if service.Connected == false {
+	if service.IsConnected() == false {
 		e = fmt.Errorf("Service is not connected to a broker")
 		return
 	}
-	if e = service.channel.QueueBind(service.Receiver.QueueName, routingKey, service.Sender.InfoExchangeName, false, nil); e != nil {
+	if e = service.Transport.QueueBind(service.Receiver.QueueName, routingKey, service.Sender.InfoExchangeName); e != nil {
+		return
+	}
+	service.addSubscription(service.Sender.InfoExchangeName, routingKey)
+	if e = service.beginConsuming(); e != nil {
 		return
 	}
-	service.Receiver.subscriptionCount++
-	service.beginConsuming()
 	logging.Log.Debugf("Subscription established: ex(%s) @ rk(%s) --> q(%s)", service.Sender.InfoExchangeName, routingKey, service.Receiver.QueueName)
 	return
 }
@@ -337,303 +714,640 @@ func (service *AmqpService) fillDriplineSenderInfo() (e error) {
 	return
 }
 
-func (service *AmqpService) beginConsuming() {
-	// Start consuming messages on the queue if there are subscriptions
+// checkOffline returns an error if the service is disconnected and the offline policy is to reject messages.
+func (service *AmqpService) checkOffline() (e error) {
+	if service.IsConnected() == false && service.Offline == OfflineReject {
+		e = ErrNotConnected
+	}
+	return
+}
+
+// IsConnected reports whether the service is connected to the broker.
+func (service *AmqpService) IsConnected() bool {
+	return service.connected.Load()
+}
+
+// replyQueueName is the name of the queue that receives replies to the service's requests.
+func (service *AmqpService) replyQueueName() (name string) {
+	name, _ = service.Receiver.replyQueueName.Load().(string)
+	return
+}
+
+// addSubscription records a binding so that it can be restored after a reconnect.
+func (service *AmqpService) addSubscription(exchange, routingKey string) {
+	service.subscriptionLock.Lock()
+	defer service.subscriptionLock.Unlock()
+	service.recordSubscription(exchange, routingKey)
+	return
+}
+
+// recordSubscription records a binding, and reports whether it was not recorded already; the subscription lock must be held.
+func (service *AmqpService) recordSubscription(exchange, routingKey string) (added bool) {
+	for _, sub := range service.subscriptions {
+		if sub.exchange == exchange && sub.routingKey == routingKey {
+			return
+		}
+	}
+	service.subscriptions = append(service.subscriptions, subscription{exchange: exchange, routingKey: routingKey})
+	service.consumeLock.Lock()
+	service.Receiver.subscriptionCount = len(service.subscriptions)
+	service.consumeLock.Unlock()
+	added = true
+	return
+}
+
+// removeSubscriptions forgets bindings, so that they are not restored after a reconnect.
+func (service *AmqpService) removeSubscriptions(exchange string, routingKeys []string) {
+	service.subscriptionLock.Lock()
+	defer service.subscriptionLock.Unlock()
+	kept := service.subscriptions[:0]
+	for _, sub := range service.subscriptions {
+		removed := false
+		for _, routingKey := range routingKeys {
+			removed = removed || (sub.exchange == exchange && sub.routingKey == routingKey)
+		}
+		if removed == false {
+			kept = append(kept, sub)
+		}
+	}
+	service.subscriptions = kept
+	service.consumeLock.Lock()
+	service.Receiver.subscriptionCount = len(service.subscriptions)
+	service.consumeLock.Unlock()
+	return
+}
+
+// beginConsuming may be called from any goroutine; the consume lock guards the message queue, which the AMQP loop reads.
+func (service *AmqpService) beginConsuming() (e error) {
+	// Start consuming messages on the queue if there are subscriptions and we're not already consuming
 	// Channel::Cancel is not executed as a deferred command, because consuming will be stopped by Channel.Close
-	if service.Receiver.subscriptionCount == 0 {
+	service.consumeLock.Lock()
+	if service.Receiver.subscriptionCount == 0 || service.Receiver.messageQueue != nil {
+		service.consumeLock.Unlock()
 		return
 	}
-	messageQueue, consumeErr := service.channel.Consume(service.Receiver.QueueName, "", false, true, true, false, nil)
-	if consumeErr != nil {
-		logging.Log.Criticalf("Unable start consuming from queue <%s>:\n\t%v", service.Receiver.QueueName, consumeErr.Error())
-		service.DoneSignal <- true
+	messageQueue, e := service.Transport.Consume(service.Receiver.QueueName)
+	if e != nil {
+		service.consumeLock.Unlock()
+		logging.Log.Errorf("Unable start consuming from queue <%s>:\n\t%v", service.Receiver.QueueName, e.Error())
 		return
 	}
 	service.Receiver.messageQueue = messageQueue
+	service.consumeLock.Unlock()
 	logging.Log.Debugf("Started consuming on queue %s", service.Receiver.QueueName)
 	// reset the amqpLoop, because the message queue has been updated
 	service.stopQueue <- false
 	return
 }
 
-// runAmqpSender is a goroutine responsible for sending AMQP messages received on a channel
+// runAmqpService is a goroutine responsible for the connection to the broker and for sending and receiving AMQP messages.
+// If the connection is lost, it is re-established according to the service's ReconnectPolicy,
+// and the queue, exchanges, and subscriptions are restored.
 // Broker address format: amqp://[user:password]@(address)[:port]
 //    Required: address
 //    Optional: user/password, port
 func runAmqpService(service *AmqpService) {
+	defer close(service.stopped)
+
 	if siErr := service.fillDriplineSenderInfo(); siErr != nil {
 		logging.Log.Warning("Unable to properly fill dripline sender info")
 	}
 
-	// Connect to the AMQP broker
-	// Deferred command: close the connection
-	connection, receiveErr := amqp.Dial(service.BrokerAddress)
-	if receiveErr != nil {
-		logging.Log.Warning("Unable to connect on first attempt.  Waiting 10 seconds to try again.")
-		time.Sleep(10 * time.Second)
-		logging.Log.Debug("Second attempt to connect")
-		connection, receiveErr = amqp.Dial(service.BrokerAddress)
-		if receiveErr != nil {
-			logging.Log.Criticalf("Unable to connect to the AMQP broker at (%s) for receiving:\n\t%v", service.BrokerAddress, receiveErr.Error())
-			service.DoneSignal <- true
-			return
-		}
+	initialAttempts := service.Reconnect.InitialAttempts
+	if initialAttempts <= 0 {
+		initialAttempts = service.Reconnect.MaxAttempts
 	}
-	defer connection.Close()
-	service.connection = connection
-	service.Connected = true
-	logging.Log.Debugf("Connected to AMQP broker (%s)", service.BrokerAddress)
-
-	// Monitor for connection closing
-	connCloseChan := make(chan *amqp.Error, 10)
-	connection.NotifyClose(connCloseChan)
+	if connErr := service.connect(initialAttempts); connErr != nil {
+		logging.Log.Criticalf("Unable to connect to the AMQP broker at (%s):\n\t%v", service.BrokerAddress, connErr.Error())
+		service.DoneSignal <- true
+		return
+	}
+	defer service.disconnect()
 
-	// We'll use these to monitor for channel cancelation and closing
-	channelCancelChan := make(chan string, 10)
-	channelCloseChan := make(chan *amqp.Error, 10)
+	// Requests for registered endpoints are handled outside of the AMQP loop
+	go service.runEndpoints()
+	defer close(service.endpointRequests)
 
-	// We wrap all of the channel declaration stuff in a closure function.
-	// This will allow us to re-open the channel again later if it gets canceled.
+	logging.Log.Notice("AMQP service started successfully")
+	service.Connected = true
+	service.DoneSignal <- false
 
-	channelSetupFunc := func() {
+	for {
+		if stopped := service.amqpLoop(); stopped {
+			break
+		}
 
-		// Create the channel object that represents the connection to the broker
-		// Deferred command: close the channel
-		channel, chanErr := connection.Channel()
-		if chanErr != nil {
-			logging.Log.Criticalf("Unable to get the AMQP channel:\n\t%v", chanErr.Error())
-			service.DoneSignal <- true
-			return
+		// The connection was lost; clean up and try to get it back
+		service.disconnect()
+		logging.Log.Info("Attempting to reconnect to the AMQP broker")
+		if connErr := service.connect(service.Reconnect.MaxAttempts); connErr != nil {
+			logging.Log.Criticalf("Unable to reconnect to the AMQP broker at (%s):\n\t%v", service.BrokerAddress, connErr.Error())
+			break
 		}
-		logging.Log.Debug("Channel with AMQP broker established")
-		service.channel = channel
+		logging.Log.Notice("AMQP service reconnected successfully")
+	}
 
+	service.DoneSignal <- true
+	return
+}
 
-		// Setup to Receive
+// connect dials the broker and sets up the queues and exchanges, retrying with exponential backoff according to the ReconnectPolicy.
+// It gives up after maxAttempts attempts, unless maxAttempts is not positive.
+// A stop request received while waiting between attempts aborts the connection attempts.
+func (service *AmqpService) connect(maxAttempts int) (e error) {
+	policy := service.Reconnect
+	interval := policy.InitialInterval
+	for attempt := 1; ; attempt++ {
+		if e = service.dial(); e == nil {
+			return
+		}
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			e = fmt.Errorf("Giving up after %d attempts: %v", attempt, e)
+			return
+		}
 
-		if service.Receiver.QueueName != "" {
-			if _, queueDeclErr := service.channel.QueueDeclare(service.Receiver.QueueName, false, true, true, false, nil); queueDeclErr != nil {
-				logging.Log.Critical(queueDeclErr.Error())
-				service.DoneSignal <- true
+		logging.Log.Warningf("Unable to connect on attempt %d.  Waiting %v to try again:\n\t%v", attempt, interval, e)
+		select {
+		case <-time.After(interval):
+		case stopSig := <-service.stopQueue:
+			if stopSig {
+				e = fmt.Errorf("Service was stopped while connecting")
 				return
 			}
-			logging.Log.Debugf("Queue declared: %s", service.Receiver.QueueName)
-
-			// Try to begin consuming, which will only actually happen if there are already subscriptions
-			service.beginConsuming()
+		}
 
-			logging.Log.Info("AMQP service ready to receive messages")
+		interval = time.Duration(float64(interval) * policy.Multiplier)
+		if interval <= 0 {
+			interval = time.Second
+		}
+		if policy.MaxInterval > 0 && interval > policy.MaxInterval {
+			interval = policy.MaxInterval
 		}
+	}
+}
 
-		// Setup to send messages
+// dial makes a single attempt to connect to the broker and set up the queues and exchanges.
+func (service *AmqpService) dial() (e error) {
+	if e = service.Transport.Dial(service.BrokerAddress); e != nil {
+		return
+	}
+	logging.Log.Debugf("Connected to AMQP broker (%s)", service.BrokerAddress)
 
-		if service.Sender.RequestExchangeName != "" {
-			exchangeErr := service.channel.ExchangeDeclare(service.Sender.RequestExchangeName, "topic", false, false, false, false, nil)
-			if exchangeErr != nil {
-				logging.Log.Criticalf("Unable to declare the requests exchange (%s)", service.Sender.RequestExchangeName)
-				service.DoneSignal <- true
-				return
-			}
-			logging.Log.Debug("Requests exchange is ready")
+	// Monitor for the connection closing
+	service.transportClosed = service.Transport.NotifyClose()
+
+	if e = service.setupTransport(); e != nil {
+		service.Transport.Close()
+		return
+	}
+	return
+}
+
+// setupTransport declares the queues and exchanges, and restores any subscriptions that were previously made.
+// The service is marked as connected while the subscriptions are still locked, so that a subscription that is recorded meanwhile
+// is either restored here or bound by its caller (see AddEndpoint).
+func (service *AmqpService) setupTransport() (e error) {
+	service.consumeLock.Lock()
+	service.Receiver.messageQueue = nil
+	service.consumeLock.Unlock()
+
+	// Setup to send messages
+
+	exchanges := []string{service.Sender.RequestExchangeName, service.Sender.AlertExchangeName, service.Sender.InfoExchangeName}
+	for _, exchange := range exchanges {
+		if exchange == "" {
+			continue
+		}
+		if e = service.Transport.ExchangeDeclare(exchange); e != nil {
+			e = fmt.Errorf("Unable to declare the exchange (%s): %v", exchange, e)
+			return
 		}
+		logging.Log.Debugf("Exchange is ready: %s", exchange)
+	}
 
-		if service.Sender.AlertExchangeName != "" {
-			exchangeErr := service.channel.ExchangeDeclare(service.Sender.AlertExchangeName, "topic", false, false, false, false, nil)
-			if exchangeErr != nil {
-				logging.Log.Criticalf("Unable to declare the alerts exchange (%s)", service.Sender.AlertExchangeName)
-				service.DoneSignal <- true
-				return
-			}
-			logging.Log.Debug("Alerts exchange is ready")
+	// Limit the number of unacknowledged messages that the broker sends to each consumer
+	if service.Prefetch > 0 {
+		if e = service.Transport.Qos(service.Prefetch); e != nil {
+			e = fmt.Errorf("Unable to set the prefetch count to %d: %v", service.Prefetch, e)
+			return
+		}
+	}
+
+	// Setup to receive replies to our requests
+
+	replyQueueName, e := service.Transport.QueueDeclare("", QueueOptions{})
+	if e != nil {
+		e = fmt.Errorf("Unable to declare the reply queue: %v", e)
+		return
+	}
+	if service.Sender.RequestExchangeName != "" {
+		if e = service.Transport.QueueBind(replyQueueName, replyQueueName, service.Sender.RequestExchangeName); e != nil {
+			e = fmt.Errorf("Unable to bind the reply queue <%s>: %v", replyQueueName, e)
+			return
 		}
+	}
+	if service.Receiver.replyQueue, e = service.Transport.Consume(replyQueueName); e != nil {
+		e = fmt.Errorf("Unable start consuming from reply queue <%s>: %v", replyQueueName, e)
+		return
+	}
+	service.Receiver.replyQueueName.Store(replyQueueName)
+	logging.Log.Debugf("Reply queue is ready: %s", replyQueueName)
+
+	// Setup to Receive
 
-		if service.Sender.InfoExchangeName != "" {
-			exchangeErr := service.channel.ExchangeDeclare(service.Sender.InfoExchangeName, "topic", false, false, false, false, nil)
-			if exchangeErr != nil {
-				logging.Log.Criticalf("Unable to declare the infos exchange (%s)", service.Sender.InfoExchangeName)
-				service.DoneSignal <- true
+	if service.Receiver.QueueName != "" {
+		if e = declareDeadLetters(service.Transport, service.DeadLetter); e != nil {
+			return
+		}
+		queueOptions := QueueOptions{DeadLetterExchange: service.DeadLetter.Exchange}
+		if _, e = service.Transport.QueueDeclare(service.Receiver.QueueName, queueOptions); e != nil {
+			return
+		}
+		logging.Log.Debugf("Queue declared: %s", service.Receiver.QueueName)
+
+		// Restore the bindings from before a reconnect
+		service.subscriptionLock.Lock()
+		defer service.subscriptionLock.Unlock()
+		for _, sub := range service.subscriptions {
+			if e = service.Transport.QueueBind(service.Receiver.QueueName, sub.routingKey, sub.exchange); e != nil {
+				e = fmt.Errorf("Unable to restore subscription ex(%s) @ rk(%s): %v", sub.exchange, sub.routingKey, e)
 				return
 			}
-			logging.Log.Debug("Infos exchange is ready")
+			logging.Log.Debugf("Subscription restored: ex(%s) @ rk(%s) --> q(%s)", sub.exchange, sub.routingKey, service.Receiver.QueueName)
 		}
 
-		service.channel.NotifyCancel(channelCancelChan)
-		service.channel.NotifyClose(channelCloseChan)
+		// Try to begin consuming, which will only actually happen if there are already subscriptions
+		if e = service.beginConsuming(); e != nil {
+			return
+		}
 
-		logging.Log.Info("AMQP service ready to send messages")
+		logging.Log.Info("AMQP service ready to receive messages")
 	}
-	// Call the connection setup function now
-	channelSetupFunc()
 
-	defer service.channel.Close()
-	defer func() {
-		if _, err := service.channel.QueueDelete(service.Receiver.QueueName, false, false, false); err != nil {
-			logging.Log.Errorf("Error while deleting queue:\n\t%v", err)
-		}
-	}()
+	logging.Log.Info("AMQP service ready to send messages")
+	service.connected.Store(true)
+	return
+}
 
-	logging.Log.Notice("AMQP service started successfully")
-	service.DoneSignal <- false
+// disconnect deletes the queue and closes the connection to the broker, if it is still open.
+func (service *AmqpService) disconnect() {
+	wasConnected := service.connected.Swap(false)
+	service.failPending()
+	if wasConnected && service.Receiver.QueueName != "" {
+		if err := service.Transport.QueueDelete(service.Receiver.QueueName); err != nil {
+			logging.Log.Debugf("Unable to delete queue:\n\t%v", err)
+		}
+	}
+	service.Transport.Close()
+	return
+}
 
-amqpLoop:
+// amqpLoop sends and receives messages until the service is stopped (returns true) or the connection to the broker is lost (returns false).
+func (service *AmqpService) amqpLoop() (stopped bool) {
 	for {
+		service.consumeLock.Lock()
+		messageQueue := service.Receiver.messageQueue
+		service.consumeLock.Unlock()
+
 		select {
 		// the control messages can stop execution
 		case stopSig, chanOpen := <-service.stopQueue:
 			if ! chanOpen {
 				logging.Log.Error("Control queue is closed")
-				break amqpLoop
+				return true
 			}
 
 			if stopSig == true {
 				logging.Log.Info("AMQP service stopping on interrupt.")
-				break amqpLoop
+				return true
 			} else {
 				logging.Log.Debug("Received on the stop queue, but it wasn't \"true\"")
-				continue amqpLoop
+				continue
 			}
-		case connectionClosed, chanOpen := <-connCloseChan:
-			if ! chanOpen {
-				logging.Log.Error("Connection-close channel is closed")
-				break amqpLoop
-			}
-
-			logging.Log.Warningf("AMQP connection was closed: %v", (*connectionClosed).Reason)
-			break amqpLoop
-		case channelCanceled, chanOpen := <-channelCancelChan:
-			if ! chanOpen {
-				logging.Log.Error("Channel-cancel channel is closed")
-				break amqpLoop
+		case closeErr, chanOpen := <-service.transportClosed:
+			if ! chanOpen || closeErr == nil {
+				logging.Log.Warning("AMQP connection was closed")
+				return false
 			}
 
-			// If the channel was canceled, we probably want to re-open it
-			logging.Log.Warningf("AMQP channel was canceled: %s", channelCanceled)
-			logging.Log.Info("Attempting to re-open the channel")
-			channelSetupFunc()
-			break amqpLoop
-		case channelClosed, chanOpen := <-channelCloseChan:
-			if ! chanOpen {
-				logging.Log.Error("Channel-close channel is closed")
-				break amqpLoop
-			}
-
-			logging.Log.Warningf("AMQP channel was closed: %v", (*channelClosed).Reason)
-			break amqpLoop
-		case request, chanOpen := <-service.Sender.requestChan:
-			if ! chanOpen {
-				logging.Log.Error("Outgoing request channel is closed")
-				break amqpLoop
-			}
-
-			logging.Log.Debug("Sending a request")
-			// encode the message
-			body, encErr := (&request).Encode()
-			if encErr != nil {
-				logging.Log.Errorf("An error occurred while encoding a request message: \n\t%v", encErr)
-				continue amqpLoop
-			}
-			(&request).send(service.channel, body)
-		case reply, chanOpen := <-service.Sender.replyChan:
+			logging.Log.Warningf("AMQP connection was closed: %v", (*closeErr).Reason)
+			return false
+		case request := <-service.Sender.requestChan:
+			service.sendRequest(request)
+		case reply := <-service.Sender.replyChan:
+			service.sendReply(reply)
+		case alert := <-service.Sender.alertChan:
+			service.sendAlert(alert)
+		case info := <-service.Sender.infoChan:
+			service.sendInfo(info)
+		// process any AMQP messages that are received
+		case amqpMessage, chanOpen := <-messageQueue:
 			if ! chanOpen {
-				logging.Log.Error("Outgoing reply channel is closed")
-				break amqpLoop
+				logging.Log.Warning("Incoming message channel is closed")
+				return false
 			}
 
-			logging.Log.Debug("Sending a reply")
-			// encode the message
-			body, encErr := (&reply).Encode()
-			if encErr != nil {
-				logging.Log.Errorf("An error occurred while encoding a reply message: \n\t%v", encErr)
-				continue amqpLoop
+			if service.AckMode == AckOnReceipt {
+				// Send an acknowledgement to the broker
+				amqpMessage.Ack(false)
 			}
-			(&reply).send(service.channel, body)
-		case alert, chanOpen := <-service.Sender.alertChan:
-			if ! chanOpen {
-				logging.Log.Error("Outgoing alert channel is closed")
-				break amqpLoop
+			if service.redeliveryExceeded(amqpMessage) {
+				logging.Log.Warningf("Rejecting a message that has been delivered more than %d times", service.MaxRedeliveries + 1)
+				service.settleDeliveries([]amqp.Delivery{amqpMessage}, false)
+				if _, isPart := amqpMessage.Headers[ChunkCountHeader]; isPart == false {
+					service.replyToUndecodable(&amqpMessage, Errorf(RCErrUnhandled, "Message was not handled after %d deliveries", service.MaxRedeliveries + 1))
+				}
+				continue
 			}
 
-			logging.Log.Debug("Sending a alert")
-			// encode the message
-			body, encErr := (&alert).Encode()
-			if encErr != nil {
-				logging.Log.Errorf("An error occurred while encoding an alert message: \n\t%v", encErr)
-				continue amqpLoop
+			amqpMessage, parts, complete, chunkErr := service.chunks.add(amqpMessage, service.Chunking)
+			if chunkErr != nil {
+				logging.Log.Errorf("An error occurred while reassembling a chunked message: \n\t%v", chunkErr)
+				continue
 			}
-			(&alert).send(service.channel, body)
-		case info, chanOpen := <-service.Sender.infoChan:
-			if ! chanOpen {
-				logging.Log.Error("Outgoing info channel is closed")
-				break amqpLoop
+			if complete == false {
+				// wait for the rest of the parts
+				continue
 			}
-
-			logging.Log.Debug("Sending a info")
-			// encode the message
-			body, encErr := (&info).Encode()
-			if encErr != nil {
-				logging.Log.Errorf("An error occurred while encoding an info message: \n\t%v", encErr)
-				continue amqpLoop
-			}
-			(&info).send(service.channel, body)
-		// process any AMQP messages that are received
-		case amqpMessage, chanOpen := <-service.Receiver.messageQueue:
-			if ! chanOpen {
-				logging.Log.Error("Incoming message channel is closed")
-				break amqpLoop
-			}
-
-			// Send an acknowledgement to the broker
-			amqpMessage.Ack(false)
+			ack := service.newDeliveryAck(parts)
 
 			decodeErr := DecodeAndHandle(&amqpMessage,
 				func(request Request){
-					service.Receiver.RequestChan <- request
+					request.ack = ack
+					endpoint, found := service.resolveEndpoint(&request)
+					if lockErr := service.checkLockout(request, endpoint); lockErr != nil {
+						logging.Log.Infof("Refusing a request to <%s>: %v", request.Target, lockErr)
+						if request.ReplyTo != "" {
+							reply := PrepareReplyToRequest(request, RetCodeOf(lockErr), lockErr.Error(), service.senderInfo)
+							service.sendReplyNow(reply)
+						}
+						logSettleError(request.Ack())
+						return
+					}
+					if found {
+						deliver(service, service.endpointRequests, endpointRequest{endpoint: endpoint, request: request},
+							func(toHandle endpointRequest) { service.refuseRequest(toHandle.request) })
+						return
+					}
+					deliver(service, service.Receiver.RequestChan, request, service.refuseRequest)
 				},
 				func(reply Reply){
-					//service.Receiver.ReplyChan <- reply
-					logging.Log.Error("Received an unexpected reply")
+					reply.ack = ack
+					service.routeReply(reply)
+					logSettleError(reply.Ack())
 				},
 				func(alert Alert){
-					service.Receiver.AlertChan <- alert
+					alert.ack = ack
+					deliver(service, service.Receiver.AlertChan, alert, func(dropped Alert) { service.dropMessage(&dropped.Message, "an alert") })
 				},
 				func(info Info){
-					service.Receiver.InfoChan <- info
+					info.ack = ack
+					deliver(service, service.Receiver.InfoChan, info, func(dropped Info) { service.dropMessage(&dropped.Message, "an info") })
 				},
 			)
 			if decodeErr != nil {
 				logging.Log.Errorf("An error occurred while decoding a message: \n\t%v", decodeErr)
-				continue amqpLoop
+				service.deadLetterUndecodable(amqpMessage, parts, decodeErr)
+				if errors.Is(decodeErr, ErrDripNoEnc) {
+					service.replyToUndecodable(&amqpMessage, decodeErr)
+				}
+				continue
 			}
 
 			//logging.Log.Printf("[amqp receiver] Message:\n\t%v", p8Message)
+		// process replies to our requests
+		case amqpMessage, chanOpen := <-service.Receiver.replyQueue:
+			if ! chanOpen {
+				logging.Log.Warning("Reply queue channel is closed")
+				return false
+			}
+
+			service.handleReplyDelivery(amqpMessage)
 		} // end select block
 	} // end for loop
+}
 
-	service.DoneSignal <- true
+// handleReplyDelivery acknowledges a delivery from the reply queue, reassembles the reply if it is chunked, and routes it to its requester.
+func (service *AmqpService) handleReplyDelivery(amqpMessage amqp.Delivery) {
+	// Send an acknowledgement to the broker
+	amqpMessage.Ack(false)
+
+	amqpMessage, _, complete, chunkErr := service.replyChunks.add(amqpMessage, service.Chunking)
+	if chunkErr != nil {
+		logging.Log.Errorf("An error occurred while reassembling a chunked reply: \n\t%v", chunkErr)
+		return
+	}
+	if complete == false {
+		// wait for the rest of the parts
+		return
+	}
+
+	decodeErr := DecodeAndHandle(&amqpMessage,
+		func(request Request){
+			logging.Log.Error("Unexpected request received on the reply queue")
+		},
+		func(reply Reply){
+			service.routeReply(reply)
+		},
+		func(alert Alert){
+			logging.Log.Error("Unexpected alert received on the reply queue")
+		},
+		func(info Info){
+			logging.Log.Error("Unexpected info received on the reply queue")
+		},
+	)
+	if decodeErr != nil {
+		logging.Log.Errorf("An error occurred while decoding a reply: \n\t%v", decodeErr)
+	}
+	return
+}
+
+// replyToUndecodable tells the sender of a message that could not be decoded what went wrong, if the sender asked for a reply.
+func (service *AmqpService) replyToUndecodable(amqpMessage *amqp.Delivery, decodeErr error) {
+	if amqpMessage.ReplyTo == "" {
+		return
+	}
+	reply := PrepareReply(amqpMessage.ReplyTo, DefaultEncoding, amqpMessage.CorrelationId, RetCodeOf(decodeErr), decodeErr.Error(), service.senderInfo)
+	service.sendReplyNow(reply)
+	return
+}
+
+// sendReplyNow encodes and publishes a reply without going through the send buffer, for use from within the AMQP loop.
+func (service *AmqpService) sendReplyNow(reply Reply) {
+	service.send(&reply, true)
 	return
 }
 
-func (message *Message) send(channel *amqp.Channel, body []byte) {
-	// Get the UUID for the correlation ID
-	correlationId := (*message).CorrId
-	if (*message).CorrId == "" {
-		correlationId = uuid.New()
+// send encodes a message in its wire format, or the service's if the message does not have one, and publishes it.
+// Requests, replies, and alerts are published as mandatory, so that a message that reaches no queue is an ErrAMQPRK error.
+func (service *AmqpService) send(toSend encodable, mandatory bool) (e error) {
+	message := toSend.base()
+	wireVersion := (*message).WireVersion
+	if wireVersion == 0 {
+		wireVersion = service.WireVersion
+	}
+	if wireVersion == 0 {
+		wireVersion = WireV1
 	}
 
-	var amqpMessage = amqp.Publishing {
-		ContentEncoding: (*message).Encoding,
-		Body: body,
-		ReplyTo: (*message).ReplyTo,
-		CorrelationId: correlationId,
+	amqpMessage, e := encodePublishing(toSend, wireVersion)
+	if e == nil {
+		e = compressPublishing(&amqpMessage, service.Compression, service.CompressionThreshold)
+	}
+	if e != nil {
+		logging.Log.Errorf("An error occurred while encoding a message: \n\t%v", e)
+		return
 	}
 
 	//logging.Log.Printf("[amqp sender] Encoded message:\n\t%v", amqpMessage)
 	logging.Log.Debugf("Sending message to routing key <%s>", (*message).Target)
 
-	// Publish!
-	pubErr := channel.Publish((*message).exchange, (*message).Target, false, false, amqpMessage)
-	if pubErr != nil {
-		logging.Log.Errorf("Error while sending message:\n\t%v", pubErr)
+	// Publish!  Large messages are sent in parts, if chunking is enabled
+	for _, part := range splitPublishing(amqpMessage, service.Chunking.Size) {
+		if e = service.Transport.Publish((*message).exchange, (*message).Target, mandatory, part); e != nil {
+			logging.Log.Errorf("Error while sending message:\n\t%v", e)
+			return
+		}
 	}
+	return
+}
+
+// sendRequest, sendReply, sendAlert, and sendInfo send a message taken from a send buffer, and report the outcome.
+func (service *AmqpService) sendRequest(request Request) {
+	logging.Log.Debug("Sending a request")
+	if sendErr := service.send(&request, true); sendErr != nil {
+		service.failRequest(request, sendErr)
+	}
+	return
+}
+
+func (service *AmqpService) sendReply(reply Reply) {
+	logging.Log.Debug("Sending a reply")
+	reportSent(reply.sent, service.send(&reply, true))
+	return
+}
+
+func (service *AmqpService) sendAlert(alert Alert) {
+	logging.Log.Debug("Sending a alert")
+	reportSent(alert.sent, service.send(&alert, true))
+	return
+}
+
+func (service *AmqpService) sendInfo(info Info) {
+	logging.Log.Debug("Sending a info")
+	reportSent(info.sent, service.send(&info, false))
+	return
+}
+
+// ErrServiceBusy is the error in the reply to a request that was dropped because the service could not keep up; it matches ErrDripTimeout.
+var ErrServiceBusy = NewError(RCErrDripTimeout, "Service is too busy to handle the request")
+
+// deliver hands a received message to a channel, from within the AMQP loop.  If the channel is full, the OverflowPolicy applies,
+// and messages that are dropped are passed to drop.
+// With OverflowBlock, the messages in the send buffers are sent, and the replies to the service's requests are routed, while waiting,
+// so that handlers waiting on a send or on a reply do not block the service.
+func deliver[M any](service *AmqpService, channel chan M, message M, drop func(M)) {
+	select {
+	case channel <- message:
+		return
+	default:
+	}
+
+	switch service.Overflow {
+	case OverflowReject:
+		drop(message)
+	case OverflowDropOldest:
+		for {
+			select {
+			case oldest := <-channel:
+				drop(oldest)
+			default:
+			}
+			select {
+			case channel <- message:
+				return
+			default:
+			}
+		}
+	default:
+		logging.Log.Debug("Waiting for room in a receiver channel")
+		replyQueue := service.Receiver.replyQueue
+		for {
+			select {
+			case channel <- message:
+				return
+			case request := <-service.Sender.requestChan:
+				service.sendRequest(request)
+			case reply := <-service.Sender.replyChan:
+				service.sendReply(reply)
+			case alert := <-service.Sender.alertChan:
+				service.sendAlert(alert)
+			case info := <-service.Sender.infoChan:
+				service.sendInfo(info)
+			case amqpMessage, chanOpen := <-replyQueue:
+				if chanOpen == false {
+					// the AMQP loop handles the closed channel once the message is delivered
+					replyQueue = nil
+					continue
+				}
+				service.handleReplyDelivery(amqpMessage)
+			case stopSig := <-service.stopQueue:
+				if stopSig == false {
+					continue
+				}
+				// leave the stop request for the AMQP loop; in the AckManual mode, the broker requeues the unacknowledged message
+				// when the service disconnects, but in the AckOnReceipt mode it was already acknowledged, so it is lost
+				if service.AckMode == AckManual {
+					logging.Log.Warning("Giving up on a received message because the service is stopping; the broker will requeue it")
+				} else {
+					logging.Log.Warning("Dropping a received message because the service is stopping")
+				}
+				select {
+				case service.stopQueue <- stopSig:
+				default:
+				}
+				return
+			}
+		}
+	}
+	return
+}
+
+// refuseRequest drops a request that the service is too busy to handle, and answers it with ErrServiceBusy.
+func (service *AmqpService) refuseRequest(request Request) {
+	if request.ReplyTo != "" {
+		reply := PrepareReplyToRequest(request, RetCodeOf(ErrServiceBusy), ErrServiceBusy.Error(), service.senderInfo)
+		service.sendReplyNow(reply)
+	}
+	service.dropMessage(&request.Message, "a request")
+	return
+}
+
+// dropMessage drops a message that the service is too busy to handle; in the AckManual mode, it is rejected.
+func (service *AmqpService) dropMessage(message *Message, kind string) {
+	logging.Log.Warningf("Dropping %s to <%s> because the service is too busy", kind, (*message).Target)
+	logSettleError(message.Reject(false))
+	return
+}
+
+// reportSent passes the outcome of sending a message to the caller waiting for it, if there is one.
+func reportSent(sent chan error, sendErr error) {
+	if sent != nil {
+		sent <- sendErr
+	}
+	return
+}
+
+// failRequest gives a request that could not be sent an error reply, so that its sender does not wait for the timeout.
+// Errors that do not have a dripline return code are reported with RCErrAMQP.
+func (service *AmqpService) failRequest(request Request, sendErr error) {
+	retCode := RCErrAMQP
+	var dripErr *DriplineError
+	if errors.As(sendErr, &dripErr) {
+		retCode = dripErr.RetCode
+	}
+	reply := PrepareReplyToRequest(request, retCode, sendErr.Error(), service.senderInfo)
+	service.routeReply(reply)
+	return
 }
 
@@ -0,0 +1,202 @@
+/*
+* service_bench_test.go
+*
+* Request round-trip benchmarks over a MemoryBroker.
+*
+* The baseline reproduces the request path from before the shared reply queue: every request opens its own connection
+* (standing in for the AMQP channel), declares, binds, and consumes from an exclusive reply queue, and tears it down after the reply.
+*
+* The memory broker answers immediately, which hides the cost of those extra broker operations; the benchmarks are also run
+* with a delay on every synchronous operation of the client's transport, standing in for the round trip to a real broker.
+ */
+
+package dripline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// echoEndpoint replies to a get with the request's payload.
+type echoEndpoint struct {
+	EndpointBase
+}
+
+func (echoEndpoint) OnGet(request Request) (interface{}, error) {
+	return request.Payload, nil
+}
+
+// newTestService starts a service with the given queue on a memory broker; it is stopped at the end of the test.
+// The service can be adjusted by setup before it starts.
+func newTestService(tb testing.TB, broker *MemoryBroker, queueName string, setup ...func(*AmqpService)) (service *AmqpService) {
+	tb.Helper()
+	service = newSizedTestService(tb, broker, queueName, DefaultBufferSizes, setup...)
+	return
+}
+
+// newSizedTestService starts a test service whose message channels have the given sizes.
+func newSizedTestService(tb testing.TB, broker *MemoryBroker, queueName string, sizes BufferSizes, setup ...func(*AmqpService)) (service *AmqpService) {
+	tb.Helper()
+	service = ServiceWithBufferSizes(sizes)
+	service.Receiver.QueueName = queueName
+	service.Transport = broker.NewTransport()
+	for _, adjust := range setup {
+		adjust(service)
+	}
+	service.StartService()
+	if service.IsConnected() == false {
+		tb.Fatalf("Service <%s> did not start", queueName)
+	}
+	tb.Cleanup(func() {
+		service.Stop()
+		<-service.DoneSignal
+	})
+	return
+}
+
+// delayedTransport waits for a fixed delay before each synchronous broker operation, like a transport to a remote broker.
+type delayedTransport struct {
+	Transport
+	delay             time.Duration
+}
+
+func (transport delayedTransport) wait() {
+	if transport.delay > 0 {
+		time.Sleep(transport.delay)
+	}
+	return
+}
+
+func (transport delayedTransport) QueueDeclare(name string, options QueueOptions) (string, error) {
+	transport.wait()
+	return transport.Transport.QueueDeclare(name, options)
+}
+
+func (transport delayedTransport) QueueBind(queue, routingKey, exchange string) error {
+	transport.wait()
+	return transport.Transport.QueueBind(queue, routingKey, exchange)
+}
+
+func (transport delayedTransport) Consume(queue string) (<-chan amqp.Delivery, error) {
+	transport.wait()
+	return transport.Transport.Consume(queue)
+}
+
+func (transport delayedTransport) Publish(exchange, routingKey string, mandatory bool, msg amqp.Publishing) error {
+	transport.wait()
+	return transport.Transport.Publish(exchange, routingKey, mandatory, msg)
+}
+
+func (transport delayedTransport) Close() error {
+	transport.wait()
+	return transport.Transport.Close()
+}
+
+// benchDelays are the broker round-trip times that the benchmarks are run with
+var benchDelays = []time.Duration{0, 100 * time.Microsecond}
+
+// newEchoService starts a service that handles requests to "echo"; it returns the client service to send them from,
+// whose transport has the given delay.
+func newEchoService(tb testing.TB, delay time.Duration) (broker *MemoryBroker, client *AmqpService) {
+	broker = NewMemoryBroker()
+	server := newTestService(tb, broker, "server")
+	if e := server.AddEndpoint("echo", echoEndpoint{}); e != nil {
+		tb.Fatal(e)
+	}
+	client = newTestService(tb, broker, "", func(service *AmqpService) {
+		service.Transport = delayedTransport{Transport: broker.NewTransport(), delay: delay}
+	})
+	return
+}
+
+// sendWithOwnReplyQueue sends a request the way SendRequest did before the shared reply queue, and waits for its reply.
+func sendWithOwnReplyQueue(broker *MemoryBroker, delay time.Duration, request Request) (reply Reply, e error) {
+	transport := delayedTransport{Transport: broker.NewTransport(), delay: delay}
+	if e = transport.Dial(""); e != nil {
+		return
+	}
+	defer transport.Close()
+
+	queueName, e := transport.QueueDeclare("", QueueOptions{})
+	if e != nil {
+		return
+	}
+	if e = transport.QueueBind(queueName, queueName, request.exchange); e != nil {
+		return
+	}
+	deliveries, e := transport.Consume(queueName)
+	if e != nil {
+		return
+	}
+
+	request.ReplyTo = queueName
+	publishing, e := encodePublishing(&request, WireV1)
+	if e != nil {
+		return
+	}
+	if e = transport.Publish(request.exchange, request.Target, true, publishing); e != nil {
+		return
+	}
+
+	select {
+	case delivery := <-deliveries:
+		delivery.Ack(false)
+		e = DecodeAndHandle(&delivery, nil, func(r Reply) { reply = r }, nil, nil)
+	case <-time.After(5 * time.Second):
+		e = fmt.Errorf("No reply to the request")
+	}
+	return
+}
+
+func benchRequest() (request Request) {
+	request = PrepareRequest("echo", "application/json", MOGet, SenderInfo{})
+	request.Payload = map[string]interface{}{"values": []interface{}{1.5, "on"}}
+	return
+}
+
+// benchRoundTrips runs a request benchmark for each of the benchDelays, sequentially and in parallel.
+func benchRoundTrips(b *testing.B, roundTrip func(broker *MemoryBroker, client *AmqpService, delay time.Duration) error) {
+	for _, delay := range benchDelays {
+		b.Run(fmt.Sprintf("delay=%v", delay), func(b *testing.B) {
+			broker, client := newEchoService(b, delay)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if e := roundTrip(broker, client, delay); e != nil {
+					b.Fatal(e)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("delay=%v/parallel", delay), func(b *testing.B) {
+			broker, client := newEchoService(b, delay)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if e := roundTrip(broker, client, delay); e != nil {
+						b.Error(e)
+						return
+					}
+				}
+			})
+		})
+	}
+	return
+}
+
+func BenchmarkRequestPerRequestQueue(b *testing.B) {
+	benchRoundTrips(b, func(broker *MemoryBroker, client *AmqpService, delay time.Duration) (e error) {
+		_, e = sendWithOwnReplyQueue(broker, delay, benchRequest())
+		return
+	})
+}
+
+func BenchmarkRequestSharedReplyQueue(b *testing.B) {
+	ctx := context.Background()
+	benchRoundTrips(b, func(broker *MemoryBroker, client *AmqpService, delay time.Duration) (e error) {
+		_, e = client.SendRequestContext(ctx, benchRequest())
+		return
+	})
+}
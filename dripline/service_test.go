@@ -0,0 +1,296 @@
+/*
+* service_test.go
+*
+* Tests of starting a service, and of sending messages through it.
+ */
+
+package dripline
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dialCounter counts the attempts to connect through a transport.
+type dialCounter struct {
+	Transport
+	dials             int
+}
+
+func (transport *dialCounter) Dial(address string) error {
+	transport.dials++
+	return transport.Transport.Dial(address)
+}
+
+// TestStartUnreachableBroker checks that a service whose broker cannot be reached gives up on starting,
+// even though it would try to reconnect forever once it has been connected.
+func TestStartUnreachableBroker(t *testing.T) {
+	service := ServiceDefaults()
+	service.BrokerAddress = "amqp://127.0.0.1:1"
+	service.Reconnect.InitialInterval = 10 * time.Millisecond
+	transport := &dialCounter{Transport: NewAmqpTransport()}
+	service.Transport = transport
+
+	started := make(chan struct{})
+	go func() {
+		service.StartService()
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		service.Stop()
+		t.Fatal("Service is still trying to connect to an unreachable broker")
+	}
+	if service.IsConnected() || service.Connected {
+		t.Errorf("Service reports a connection to an unreachable broker")
+	}
+	if transport.dials != service.Reconnect.InitialAttempts {
+		t.Errorf("Service tried to connect %d times, expected %d", transport.dials, service.Reconnect.InitialAttempts)
+	}
+	select {
+	case <-service.stopped:
+	case <-time.After(time.Second):
+		t.Errorf("Service did not stop after failing to start")
+	}
+}
+
+// newSilentService starts a service that receives the requests to "silent" on the echo service's broker, and does not answer them;
+// it returns the silent service and the echo service's client.
+func newSilentService(t *testing.T) (silent, client *AmqpService) {
+	broker, client := newEchoService(t, 0)
+	silent = newTestService(t, broker, "silent")
+	if e := silent.SubscribeToRequests("silent.#"); e != nil {
+		t.Fatal(e)
+	}
+	return
+}
+
+// pendingCount gives the number of requests that are waiting for replies.
+func pendingCount(service *AmqpService) int {
+	service.pendingLock.Lock()
+	defer service.pendingLock.Unlock()
+	return len(service.pendingReplies)
+}
+
+func TestMemorySendRequestContext(t *testing.T) {
+	_, client := newSilentService(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if _, e := client.SendRequestContext(ctx, PrepareRequest("silent", "application/json", MOGet, SenderInfo{})); e != ErrReplyTimeout {
+		t.Errorf("Request past its deadline gave %v, expected ErrReplyTimeout", e)
+	}
+	if count := pendingCount(client); count != 0 {
+		t.Errorf("%d requests are still waiting after the deadline", count)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50 * time.Millisecond, cancel)
+	if _, e := client.SendRequestContext(ctx, PrepareRequest("silent", "application/json", MOGet, SenderInfo{})); e != context.Canceled {
+		t.Errorf("Canceled request gave %v, expected context.Canceled", e)
+	}
+	if count := pendingCount(client); count != 0 {
+		t.Errorf("%d requests are still waiting after being canceled", count)
+	}
+}
+
+func TestMemorySendRequestSync(t *testing.T) {
+	_, client := newSilentService(t)
+
+	request := PrepareRequest("echo", "application/json", MOGet, SenderInfo{})
+	request.Payload = 2.5
+	reply, e := client.SendRequestSync(request, 5 * time.Second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if reply.RetCode != RCSuccess || reply.Payload != 2.5 || reply.CorrId == "" {
+		t.Errorf("Reply has RetCode %d, payload %#v, and corr. ID %q", reply.RetCode, reply.Payload, reply.CorrId)
+	}
+
+	if _, e = client.SendRequestSync(PrepareRequest("silent", "application/json", MOGet, SenderInfo{}), 50 * time.Millisecond); e != ErrReplyTimeout {
+		t.Errorf("Unanswered request gave %v, expected ErrReplyTimeout", e)
+	}
+	if count := pendingCount(client); count != 0 {
+		t.Errorf("%d requests are still waiting after the timeout", count)
+	}
+}
+
+// TestMemorySendRequestTimeout checks that SendRequest delivers a timeout reply when no reply arrives in time.
+func TestMemorySendRequestTimeout(t *testing.T) {
+	_, client := newSilentService(t)
+
+	request := PrepareRequest("silent", "application/json", MOGet, SenderInfo{})
+	request.CorrId = "unanswered"
+	replies, e := client.SendRequest(request, 50 * time.Millisecond)
+	if e != nil {
+		t.Fatal(e)
+	}
+	select {
+	case reply := <-replies:
+		if reply.RetCode != RCErrDripTimeout || reply.ReturnMessage != ErrReplyTimeout.Error() || reply.CorrId != "unanswered" {
+			t.Errorf("Timeout reply has RetCode %d, message %q, and corr. ID %q", reply.RetCode, reply.ReturnMessage, reply.CorrId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No reply was delivered after the timeout")
+	}
+	if count := pendingCount(client); count != 0 {
+		t.Errorf("%d requests are still waiting after the timeout", count)
+	}
+}
+
+// TestMemoryLateReply checks that a reply that arrives after its request stopped waiting is dropped,
+// while other replies that nobody waits for still go to the reply channel.
+func TestMemoryLateReply(t *testing.T) {
+	silent, client := newSilentService(t)
+
+	request := PrepareRequest("silent", "application/json", MOGet, SenderInfo{})
+	request.CorrId = "late"
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if _, e := client.SendRequestContext(ctx, request); e != ErrReplyTimeout {
+		t.Fatalf("Unanswered request gave %v, expected ErrReplyTimeout", e)
+	}
+
+	received := <-silent.Receiver.RequestChan
+	if e := silent.SendReply(PrepareReplyToRequest(received, RCSuccess, "late", SenderInfo{})); e != nil {
+		t.Fatal(e)
+	}
+	received.CorrId = "unknown"
+	if e := silent.SendReply(PrepareReplyToRequest(received, RCSuccess, "unknown", SenderInfo{})); e != nil {
+		t.Fatal(e)
+	}
+	select {
+	case reply := <-client.Receiver.ReplyChan:
+		if reply.CorrId != "unknown" {
+			t.Errorf("Reply channel received the reply with corr. ID %q, expected \"unknown\"", reply.CorrId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reply that nobody waits for did not go to the reply channel")
+	}
+}
+
+// outageTransport cannot connect while the broker is down.
+type outageTransport struct {
+	Transport
+	down              *atomic.Bool
+}
+
+func (transport outageTransport) Dial(address string) error {
+	if transport.down.Load() {
+		return errors.New("Broker is down")
+	}
+	return transport.Transport.Dial(address)
+}
+
+// waitFor waits until a condition holds.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for start := time.Now(); condition() == false; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5 * time.Second {
+			t.Fatalf("Timed out waiting until %s", what)
+		}
+	}
+	return
+}
+
+// newOutageServices starts a sender whose broker can be taken down, and a listener for its alerts to "sensor.#".
+// The sender has room for two alerts in its send buffer.
+func newOutageServices(t *testing.T, offline OfflinePolicy) (sender, listener *AmqpService, down *atomic.Bool) {
+	broker := NewMemoryBroker()
+	listener = newTestService(t, broker, "listener")
+	if e := listener.SubscribeToAlerts("sensor.#"); e != nil {
+		t.Fatal(e)
+	}
+	down = new(atomic.Bool)
+	sizes := DefaultBufferSizes
+	sizes.SendAlerts = 2
+	sender = newSizedTestService(t, broker, "", sizes, func(service *AmqpService) {
+		service.Transport = outageTransport{Transport: broker.NewTransport(), down: down}
+		service.Reconnect.InitialInterval = 10 * time.Millisecond
+		service.Reconnect.MaxInterval = 10 * time.Millisecond
+		service.Offline = offline
+	})
+	return
+}
+
+// takeDown disconnects the services from the broker, and keeps the sender from reconnecting.
+func takeDown(t *testing.T, broker *MemoryBroker, sender *AmqpService, down *atomic.Bool) {
+	t.Helper()
+	down.Store(true)
+	broker.DropConnections()
+	waitFor(t, "the sender is disconnected", func() bool { return sender.IsConnected() == false })
+	return
+}
+
+func sensorAlert(value float64) (alert Alert) {
+	alert = PrepareAlert("sensor.a", "application/json", SenderInfo{})
+	alert.Payload = value
+	return
+}
+
+func TestMemoryOfflineReject(t *testing.T) {
+	sender, listener, down := newOutageServices(t, OfflineReject)
+	takeDown(t, listener.Transport.(*MemoryTransport).broker, sender, down)
+
+	if e := sender.SendAlertAsync(sensorAlert(1)).Wait(); e != ErrNotConnected {
+		t.Errorf("Alert sent while disconnected gave %v, expected ErrNotConnected", e)
+	}
+	if e := sender.SendAlert(sensorAlert(2)); errors.Is(e, ErrAMQPConn) == false {
+		t.Errorf("Alert sent while disconnected gave %v, expected an ErrAMQPConn error", e)
+	}
+	if _, e := sender.SendRequest(PrepareRequest("listener", "application/json", MOGet, SenderInfo{}), time.Second); e != ErrNotConnected {
+		t.Errorf("Request sent while disconnected gave %v, expected ErrNotConnected", e)
+	}
+
+	down.Store(false)
+	waitFor(t, "the services reconnect", func() bool { return sender.IsConnected() && listener.IsConnected() })
+	if e := sender.SendAlert(sensorAlert(3)); e != nil {
+		t.Fatalf("Alert sent after reconnecting gave %v", e)
+	}
+	if received := receiveBacklog(listener); len(received) != 1 || received[0] != 3. {
+		t.Errorf("Listener received alerts %v, expected only the one sent after reconnecting", received)
+	}
+}
+
+func TestMemoryOfflineHold(t *testing.T) {
+	sender, listener, down := newOutageServices(t, OfflineHold)
+	takeDown(t, listener.Transport.(*MemoryTransport).broker, sender, down)
+
+	held := []*SendFuture{sender.SendAlertAsync(sensorAlert(1)), sender.SendAlertAsync(sensorAlert(2))}
+	if e := sender.SendAlertAsync(sensorAlert(3)).Wait(); e != ErrSendBufferFull {
+		t.Errorf("Alert sent while disconnected with a full buffer gave %v, expected ErrSendBufferFull", e)
+	}
+
+	waitFor(t, "the listener reconnects", listener.IsConnected)
+	down.Store(false)
+	for _, future := range held {
+		if e := future.Wait(); e != nil {
+			t.Errorf("Held alert gave %v after reconnecting", e)
+		}
+	}
+	if received := receiveBacklog(listener); len(received) != 2 || received[0] != 1. || received[1] != 2. {
+		t.Errorf("Listener received alerts %v, expected the two that were held", received)
+	}
+}
+
+func TestMemoryServiceStopped(t *testing.T) {
+	sender, listener, down := newOutageServices(t, OfflineHold)
+	takeDown(t, listener.Transport.(*MemoryTransport).broker, sender, down)
+
+	held := sender.SendAlertAsync(sensorAlert(1))
+	sender.Stop()
+	if e := held.Wait(); e != ErrServiceStopped {
+		t.Errorf("Alert held when the service stopped gave %v, expected ErrServiceStopped", e)
+	}
+	<-sender.stopped
+	if e := sender.SendAlertAsync(sensorAlert(2)).Wait(); e != ErrServiceStopped {
+		t.Errorf("Alert sent after the service stopped gave %v, expected ErrServiceStopped", e)
+	}
+	if _, e := sender.SendRequest(PrepareRequest("listener", "application/json", MOGet, SenderInfo{}), time.Second); e != ErrServiceStopped {
+		t.Errorf("Request sent after the service stopped gave %v, expected ErrServiceStopped", e)
+	}
+}
@@ -0,0 +1,191 @@
+#!/usr/bin/env python3
+"""
+Generates vectors.json, the golden corpus of dripline wire messages.
+
+Every message is written in both wire formats and both encodings.  In the v1 format the
+whole message is in the body; in the v2 format the metadata is in the AMQP headers, under
+the names in V2_HEADERS, and the body holds only the payload.  v1 messages are written as
+older senders write them, with the MIME type in content_encoding and no content_type;
+v2 messages also carry the MIME type in content_type.
+
+The vectors are synthetic: they are not captured from, or generated with, the Python or
+C++ implementations.  The message elements follow the dripline specification; JSON
+bodies are written with json.dumps' default separators, and msgpack bodies with the
+hand-written pack() below, which writes strings as str (not bin).  Checking the corpus
+against the other implementations has to be done separately.
+Run from this directory; the output is deterministic.
+"""
+
+import base64
+import json
+import struct
+
+MSG_TYPES = {"reply": 2, "request": 3, "alert": 4, "info": 5}
+MSG_OPS = {"set": 0, "get": 1, "config": 6, "send": 7, "run": 8, "command": 9}
+# The same names as the return-code registry in errors.go
+RET_CODES = {
+    "success": 0, "warning_no_action_taken": 1,
+    "amqp_error": 100, "amqp_error_broker_connection": 101, "amqp_error_routingkey_notfound": 102,
+    "resource_error": 200, "resource_error_connection": 201, "resource_error_no_response": 202,
+    "service_error": 300, "service_error_no_encoding": 301, "service_error_decoding_fail": 302,
+    "service_error_bad_payload": 303, "service_error_invalid_value": 304, "service_error_timeout": 305,
+    "service_error_invalid_method": 306, "service_error_access_denied": 307, "service_error_invalid_key": 308,
+    "database_error": 400, "unhandled_exception": 999,
+}
+
+# The v2 headers that carry the elements of a v1 message body, as in wire.go
+V2_HEADERS = {
+    "msgtype": "message_type", "msgop": "message_operation", "retcode": "return_code", "return_msg": "return_message",
+    "specifier": "specifier", "lockout_key": "lockout_key", "timestamp": "timestamp", "sender_info": "sender_info",
+}
+
+
+def pack(obj):
+    """A minimal msgpack encoder for the types used here, using the smallest format for each value."""
+    if obj is None:
+        return b"\xc0"
+    if obj is True:
+        return b"\xc3"
+    if obj is False:
+        return b"\xc2"
+    if isinstance(obj, int):
+        if 0 <= obj < 0x80:
+            return struct.pack("B", obj)
+        if -32 <= obj < 0:
+            return struct.pack("b", obj)
+        if 0 <= obj <= 0xff:
+            return b"\xcc" + struct.pack(">B", obj)
+        if 0 <= obj <= 0xffff:
+            return b"\xcd" + struct.pack(">H", obj)
+        if 0 <= obj <= 0xffffffff:
+            return b"\xce" + struct.pack(">I", obj)
+        if obj >= 0:
+            return b"\xcf" + struct.pack(">Q", obj)
+        if obj >= -0x80:
+            return b"\xd0" + struct.pack(">b", obj)
+        if obj >= -0x8000:
+            return b"\xd1" + struct.pack(">h", obj)
+        if obj >= -0x80000000:
+            return b"\xd2" + struct.pack(">i", obj)
+        return b"\xd3" + struct.pack(">q", obj)
+    if isinstance(obj, float):
+        return b"\xcb" + struct.pack(">d", obj)
+    if isinstance(obj, str):
+        raw = obj.encode("utf-8")
+        if len(raw) < 32:
+            return struct.pack("B", 0xa0 | len(raw)) + raw
+        if len(raw) <= 0xff:
+            return b"\xd9" + struct.pack(">B", len(raw)) + raw
+        return b"\xda" + struct.pack(">H", len(raw)) + raw
+    if isinstance(obj, list):
+        if len(obj) < 16:
+            head = struct.pack("B", 0x90 | len(obj))
+        else:
+            head = b"\xdc" + struct.pack(">H", len(obj))
+        return head + b"".join(pack(elem) for elem in obj)
+    if isinstance(obj, dict):
+        if len(obj) < 16:
+            head = struct.pack("B", 0x80 | len(obj))
+        else:
+            head = b"\xde" + struct.pack(">H", len(obj))
+        return head + b"".join(pack(key) + pack(value) for key, value in obj.items())
+    raise TypeError("cannot pack %r" % (obj,))
+
+
+def sender_info(username):
+    return {
+        "package": "dripline",
+        "exe": "/usr/local/bin/dragonfly",
+        "version": "2.4.1",
+        "commit": "g4f2c1e9",
+        "hostname": "daq.p8.example",
+        "username": username,
+    }
+
+
+def message(msgtype, timestamp, username, payload, **elements):
+    body = {"msgtype": MSG_TYPES[msgtype], "timestamp": timestamp, "sender_info": sender_info(username), "payload": payload}
+    body.update(elements)
+    return body
+
+
+def vectors():
+    payloads = [
+        None,
+        {"values": [3.25]},
+        {"values": ["on"], "units": "V"},
+        {"channels": [1, 2, 3], "enabled": True},
+        [1, -2, 300, 70000, 5000000000],
+        "a plain string",
+    ]
+    for index, (name, msgop) in enumerate(MSG_OPS.items()):
+        yield ("request_" + name, "dt_bob.ch%d" % index, "amq.gen-reply%d" % index,
+               message("request", "2016-04-18T17:02:11Z", "alice", payloads[index % len(payloads)],
+                       msgop=msgop, lockout_key=None, specifier=None))
+    yield ("request_specifier", "psu", "amq.gen-specifier",
+           message("request", "2016-04-18T17:02:12.513082Z", "alice", None,
+                   msgop=MSG_OPS["get"], specifier="ch1.voltage"))
+    yield ("request_lockout_key", "psu.output", "amq.gen-lockout",
+           message("request", "2016-04-18T17:02:13Z", "alice", {"values": [False]},
+                   msgop=MSG_OPS["set"], lockout_key="5d2cbd66a7d14b6c9c6b4e3f0a1c2d3e"))
+    yield ("request_no_reply", "psu.reset", "",
+           message("request", "2016-04-18T17:02:14Z", "alice", {},
+                   msgop=MSG_OPS["command"]))
+    for name, retcode in RET_CODES.items():
+        payload = {"value": 1.5} if retcode == 0 else None
+        yield ("reply_" + name, "amq.gen-reply0", "",
+               message("reply", "2016-04-18T17:02:15Z", "bob", payload,
+                       retcode=retcode, return_msg="" if retcode == 0 else name.replace("_", " ")))
+    yield ("request_unknown_elements", "dt_bob", "amq.gen-unknown",
+           message("request", "2016-04-18T17:02:16Z", "alice", None,
+                   msgop=MSG_OPS["get"], trace_id="0af7651916cd43dd", hops=[{"service": "relay", "count": 2}]))
+    yield ("reply_unknown_elements", "amq.gen-unknown", "",
+           message("reply", "2016-04-18T17:02:17Z", "bob", 7, retcode=0, return_msg="", trace_id="0af7651916cd43dd"))
+    yield ("alert_sensor_value", "sensor_value.temperature", "",
+           message("alert", "2016-04-18T17:03:00Z", "slow_control", {"value_raw": "23.4", "value_cal": 23.4}))
+    yield ("alert_status", "status_message.error.daq", "",
+           message("alert", "2016-04-18T17:03:01.000001Z", "daq", "disk is nearly full"))
+    yield ("info_heartbeat", "heartbeat.daq", "",
+           message("info", "2016-04-18T17:04:00Z", "daq", None))
+    yield ("info_status", "status.daq", "",
+           message("info", "2016-04-18T17:04:01Z", "daq", {"state": "running", "run_id": 4521}))
+
+
+def encode(obj, encoding, vector):
+    """Stores the encoded obj as the body of the vector, as text for JSON and in base64 otherwise."""
+    if encoding == "application/json":
+        vector["body"] = json.dumps(obj)
+    else:
+        vector["body_base64"] = base64.b64encode(pack(obj)).decode("ascii")
+
+
+def main():
+    corpus = []
+    for name, routing_key, reply_to, body in vectors():
+        for version in (1, 2):
+            for encoding in ("application/json", "application/msgpack"):
+                vector = {
+                    "name": "%s_%s" % (name, encoding.split("/")[1]) + ("_v2" if version == 2 else ""),
+                    "properties": {
+                        "content_encoding": encoding,
+                        "content_type": encoding if version == 2 else "",
+                        "routing_key": routing_key,
+                        "correlation_id": "a9f5c3d2-%04x-4e1b-8c7d-2f6a0b9e1d4c" % (len(corpus)),
+                        "reply_to": reply_to,
+                    },
+                }
+                if version == 1:
+                    encode(body, encoding, vector)
+                else:
+                    vector["properties"]["headers"] = {
+                        V2_HEADERS.get(element, element): value for element, value in body.items() if element != "payload"
+                    }
+                    encode(body["payload"], encoding, vector)
+                corpus.append(vector)
+    with open("vectors.json", "w") as output:
+        json.dump(corpus, output, indent=2)
+        output.write("\n")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,260 @@
+/*
+* transport.go
+*
+* A Transport is the link between an AmqpService and a message broker.
+* AmqpTransport talks to a real AMQP broker; see memory.go for an in-process broker.
+ */
+
+package dripline
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Transport covers the broker operations used by an AmqpService.
+// All exchanges are topic exchanges.  Queues are exclusive to the transport that declared them and are deleted when it closes,
+// unless they are declared as durable.
+type Transport interface {
+	// Dial connects to the broker; it may be called again after Close to reconnect.
+	Dial(address string) error
+	// Close disconnects from the broker.
+	Close() error
+	// NotifyClose returns a channel that receives an error and is then closed when the connection is lost.
+	NotifyClose() <-chan *amqp.Error
+
+	// ExchangeDeclare declares a topic exchange.
+	ExchangeDeclare(name string) error
+	// QueueDeclare declares a queue and returns its name; if name is empty, the broker chooses one.
+	QueueDeclare(name string, options QueueOptions) (string, error)
+	// QueueBind routes messages published to exchange with a matching routing key to the queue.
+	QueueBind(queue, routingKey, exchange string) error
+	// QueueDelete deletes a queue.
+	QueueDelete(name string) error
+	// Qos limits the number of unacknowledged messages delivered to each consumer that is started afterwards; zero means no limit.
+	Qos(prefetchCount int) error
+	// Consume starts delivering the messages from a queue.
+	Consume(queue string) (<-chan amqp.Delivery, error)
+	// Publish sends a message to an exchange with the given routing key, and waits until the broker has taken responsibility for it.
+	// If mandatory is set and no queue is bound to receive the message, the error matches ErrAMQPRK.
+	Publish(exchange, routingKey string, mandatory bool, msg amqp.Publishing) error
+}
+
+// QueueOptions are the properties of a declared queue.
+type QueueOptions struct {
+	// Durable queues can be used by any transport, and are kept when the transport that declared them closes
+	Durable           bool
+	// DeadLetterExchange receives the messages that are rejected from the queue without being requeued
+	DeadLetterExchange string
+	// DeadLetterRoutingKey replaces the routing key of dead-lettered messages, if it is not empty
+	DeadLetterRoutingKey string
+}
+
+// arguments gives the AMQP queue arguments for the options.
+func (options QueueOptions) arguments() (args amqp.Table) {
+	if options.DeadLetterExchange == "" {
+		return
+	}
+	args = amqp.Table{"x-dead-letter-exchange": options.DeadLetterExchange}
+	if options.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = options.DeadLetterRoutingKey
+	}
+	return
+}
+
+// AmqpTransport is a Transport that uses a connection to an AMQP broker such as RabbitMQ.
+// The channel is put in confirm mode, so that each publish waits for the broker's acknowledgement.
+// The connection is replaced by Dial and Close while other goroutines use it, so it is guarded by a lock;
+// operations on a closed transport return ErrNotConnected.
+type AmqpTransport struct {
+	lock              sync.Mutex
+	connection        *amqp.Connection
+	channel           *amqp.Channel
+	closed            chan *amqp.Error
+	confirms          chan amqp.Confirmation
+	returns           chan amqp.Return
+}
+
+// NewAmqpTransport creates a Transport for an AMQP broker.
+func NewAmqpTransport() (transport *AmqpTransport) {
+	transport = &AmqpTransport{}
+	return
+}
+
+// Dial connects to the AMQP broker and opens the channel.
+// Broker address format: amqp://[user:password]@(address)[:port]
+func (transport *AmqpTransport) Dial(address string) (e error) {
+	connection, e := amqp.Dial(address)
+	if e != nil {
+		return
+	}
+	channel, e := connection.Channel()
+	if e != nil {
+		connection.Close()
+		e = fmt.Errorf("Unable to get the AMQP channel: %v", e)
+		return
+	}
+	if e = channel.Confirm(false); e != nil {
+		channel.Close()
+		connection.Close()
+		e = fmt.Errorf("Unable to put the AMQP channel in confirm mode: %v", e)
+		return
+	}
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	// Monitor for connection closing and channel cancelation and closing
+	connCloseChan := connection.NotifyClose(make(chan *amqp.Error, 1))
+	channelCloseChan := channel.NotifyClose(make(chan *amqp.Error, 1))
+	channelCancelChan := channel.NotifyCancel(make(chan string, 1))
+	closed := make(chan *amqp.Error, 1)
+	go func(closed chan *amqp.Error) {
+		var closeErr *amqp.Error
+		select {
+		case closeErr = <-connCloseChan:
+		case closeErr = <-channelCloseChan:
+		case tag := <-channelCancelChan:
+			closeErr = &amqp.Error{Reason: fmt.Sprintf("consumer %s was canceled", tag)}
+		}
+		if closeErr == nil {
+			closeErr = &amqp.Error{Reason: "connection closed"}
+		}
+		closed <- closeErr
+		close(closed)
+	}(closed)
+
+	transport.lock.Lock()
+	transport.connection = connection
+	transport.channel = channel
+	transport.closed = closed
+	transport.confirms = confirms
+	transport.returns = returns
+	transport.lock.Unlock()
+	return
+}
+
+// Close closes the channel and the connection.
+func (transport *AmqpTransport) Close() (e error) {
+	transport.lock.Lock()
+	channel, connection := transport.channel, transport.connection
+	transport.channel = nil
+	transport.connection = nil
+	transport.lock.Unlock()
+
+	if channel != nil {
+		channel.Close()
+	}
+	if connection != nil {
+		e = connection.Close()
+	}
+	return
+}
+
+func (transport *AmqpTransport) NotifyClose() <-chan *amqp.Error {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	return transport.closed
+}
+
+// openChannel returns the channel, or ErrNotConnected if the transport is not connected.
+func (transport *AmqpTransport) openChannel() (channel *amqp.Channel, e error) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	channel = transport.channel
+	if channel == nil {
+		e = ErrNotConnected
+	}
+	return
+}
+
+func (transport *AmqpTransport) ExchangeDeclare(name string) (e error) {
+	channel, e := transport.openChannel()
+	if e != nil {
+		return
+	}
+	e = channel.ExchangeDeclare(name, "topic", false, false, false, false, nil)
+	return
+}
+
+func (transport *AmqpTransport) QueueDeclare(name string, options QueueOptions) (queueName string, e error) {
+	channel, e := transport.openChannel()
+	if e != nil {
+		return
+	}
+	exclusive := options.Durable == false
+	queue, e := channel.QueueDeclare(name, options.Durable, exclusive, exclusive, false, options.arguments())
+	queueName = queue.Name
+	return
+}
+
+func (transport *AmqpTransport) QueueBind(queue, routingKey, exchange string) (e error) {
+	channel, e := transport.openChannel()
+	if e != nil {
+		return
+	}
+	e = channel.QueueBind(queue, routingKey, exchange, false, nil)
+	return
+}
+
+func (transport *AmqpTransport) QueueDelete(name string) (e error) {
+	channel, e := transport.openChannel()
+	if e != nil {
+		return
+	}
+	_, e = channel.QueueDelete(name, false, false, false)
+	return
+}
+
+func (transport *AmqpTransport) Qos(prefetchCount int) (e error) {
+	channel, e := transport.openChannel()
+	if e != nil {
+		return
+	}
+	e = channel.Qos(prefetchCount, 0, false)
+	return
+}
+
+func (transport *AmqpTransport) Consume(queue string) (deliveries <-chan amqp.Delivery, e error) {
+	channel, e := transport.openChannel()
+	if e != nil {
+		return
+	}
+	deliveries, e = channel.Consume(queue, "", false, true, true, false, nil)
+	return
+}
+
+// Publish sends a message and waits for the broker to confirm it.
+// The broker returns an unroutable mandatory message before confirming it, so the return is already waiting when the confirmation arrives.
+// Publish must not be called concurrently.
+func (transport *AmqpTransport) Publish(exchange, routingKey string, mandatory bool, msg amqp.Publishing) (e error) {
+	transport.lock.Lock()
+	channel, confirms, returns := transport.channel, transport.confirms, transport.returns
+	transport.lock.Unlock()
+	if channel == nil {
+		e = ErrNotConnected
+		return
+	}
+
+	if e = channel.Publish(exchange, routingKey, mandatory, false, msg); e != nil {
+		return
+	}
+	confirmation, chanOpen := <-confirms
+	if ! chanOpen {
+		e = NewError(RCErrAMQPConn, "Channel was closed before the broker confirmed the message")
+		return
+	}
+	select {
+	case returned, isReturned := <-returns:
+		if isReturned {
+			e = Errorf(RCErrAMQPRK, "Message to <%s> on exchange <%s> was returned by the broker: %s", routingKey, exchange, returned.ReplyText)
+			return
+		}
+	default:
+	}
+	if confirmation.Ack == false {
+		e = Errorf(RCErrAMQP, "Broker did not accept the message to <%s>", routingKey)
+	}
+	return
+}
@@ -0,0 +1,39 @@
+/*
+* transport_test.go
+*
+* Tests of the transport to an AMQP broker that can be run without a broker.
+ */
+
+package dripline
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// TestAmqpTransportNotConnected checks that the operations of a transport that is not connected fail with ErrNotConnected.
+func TestAmqpTransportNotConnected(t *testing.T) {
+	transport := NewAmqpTransport()
+	if e := transport.Dial("amqp://127.0.0.1:1"); e == nil {
+		t.Fatal("Dialing an unreachable broker succeeded")
+	}
+	transport.Close()
+
+	_, declareErr := transport.QueueDeclare("queue", QueueOptions{})
+	_, consumeErr := transport.Consume("queue")
+	errs := map[string]error {
+		"ExchangeDeclare": transport.ExchangeDeclare("requests"),
+		"QueueDeclare":    declareErr,
+		"QueueBind":       transport.QueueBind("queue", "key", "requests"),
+		"QueueDelete":     transport.QueueDelete("queue"),
+		"Qos":             transport.Qos(1),
+		"Consume":         consumeErr,
+		"Publish":         transport.Publish("requests", "key", false, amqp.Publishing{}),
+	}
+	for operation, e := range errs {
+		if e != ErrNotConnected {
+			t.Errorf("%s on a closed transport gave %v, expected ErrNotConnected", operation, e)
+		}
+	}
+}
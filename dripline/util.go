@@ -2,36 +2,123 @@
 package dripline
 
 import (
+	"encoding/json"
 	//"errors"
-	//"fmt"
+	"fmt"
+	"math"
 	//"os"
 	//"path/filepath"
+	"strconv"
 	//"strings"
 )
 
-// ConvertToMsgCode converts interface{} values with the types that typically underly JSON-encoded integers
-func ConvertToMsgCode(ifcVal interface{}) (MsgCodeT) {
+// ConvertToMsgCode converts a decoded message code to a MsgCodeT.
+// It accepts all of the integer and floating-point types that JSON, msgpack, and CBOR decoding can produce, json.Number, and decimal strings.
+// Negative, non-integral, and out-of-range values are reported as errors.
+func ConvertToMsgCode(ifcVal interface{}) (code MsgCodeT, e error) {
 	switch val := ifcVal.(type) {
+		case int:
+			return signedToMsgCode(int64(val))
+		case int8:
+			return signedToMsgCode(int64(val))
+		case int16:
+			return signedToMsgCode(int64(val))
+		case int32:
+			return signedToMsgCode(int64(val))
 		case int64:
-			return MsgCodeT(val)
+			return signedToMsgCode(val)
+		case uint:
+			return MsgCodeT(val), nil
+		case uint8:
+			return MsgCodeT(val), nil
+		case uint16:
+			return MsgCodeT(val), nil
+		case uint32:
+			return MsgCodeT(val), nil
 		case uint64:
-			return MsgCodeT(val)
+			return MsgCodeT(val), nil
+		case float32:
+			return floatToMsgCode(float64(val))
+		case float64:
+			return floatToMsgCode(val)
+		case json.Number:
+			return stringToMsgCode(string(val))
+		case string:
+			return stringToMsgCode(val)
+		case []uint8:
+			return stringToMsgCode(string(val))
 		default:
-			return 999
+			return 0, fmt.Errorf("expected a number, got %T", ifcVal)
+	}
+}
+
+func signedToMsgCode(val int64) (MsgCodeT, error) {
+	if val < 0 {
+		return 0, fmt.Errorf("value %d is out of range", val)
 	}
+	return MsgCodeT(val), nil
 }
 
-// ConvertToMsgCode converts interface{} values with the types that typically underly JSON-encoded integers
-func ConvertToString(ifcVal interface{}) (string) {
+func floatToMsgCode(val float64) (MsgCodeT, error) {
+	if val != math.Trunc(val) {
+		return 0, fmt.Errorf("value %v is not an integer", val)
+	}
+	// 2^64 is exactly representable; it and anything larger does not fit
+	if val < 0 || val >= math.Exp2(64) {
+		return 0, fmt.Errorf("value %v is out of range", val)
+	}
+	return MsgCodeT(val), nil
+}
+
+func stringToMsgCode(val string) (MsgCodeT, error) {
+	code, parseErr := strconv.ParseUint(val, 10, 64)
+	if parseErr != nil {
+		if floatVal, floatErr := strconv.ParseFloat(val, 64); floatErr == nil {
+			return floatToMsgCode(floatVal)
+		}
+		return 0, fmt.Errorf("value %q is not an unsigned integer", val)
+	}
+	return MsgCodeT(code), nil
+}
+
+// ConvertToString converts decoded string values, which may be raw bytes when decoded from msgpack.
+func ConvertToString(ifcVal interface{}) (value string, e error) {
+	value, isString := stringValue(ifcVal)
+	if isString == false {
+		e = fmt.Errorf("expected a string, got %T", ifcVal)
+	}
+	return
+}
+
+// stringValue gets a string from a decoded value; msgpack may decode strings as raw bytes.
+func stringValue(ifcVal interface{}) (value string, isString bool) {
 	switch val := ifcVal.(type) {
 		case string:
-			return val
+			return val, true
 		case []uint8:
-			return string(val)
+			return string(val), true
 		default:
-			return "UNKNOWN MESSAGE TYPE"
+			return "", false
 	}
 }
 
-
-
+// stringMap gets a map with string keys from a decoded value.
+// JSON decodes maps as map[string]interface{}, while msgpack decodes nested maps as map[interface{}]interface{}.
+func stringMap(ifcVal interface{}) (value map[string]interface{}, isMap bool) {
+	switch val := ifcVal.(type) {
+		case map[string]interface{}:
+			return val, true
+		case map[interface{}]interface{}:
+			value = make(map[string]interface{}, len(val))
+			for keyIfc, elem := range val {
+				key, isString := stringValue(keyIfc)
+				if isString == false {
+					return nil, false
+				}
+				value[key] = elem
+			}
+			return value, true
+		default:
+			return nil, false
+	}
+}
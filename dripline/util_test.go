@@ -0,0 +1,106 @@
+/*
+* util_test.go
+*
+* Tests of the conversions of decoded values.
+ */
+
+package dripline
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestConvertToMsgCode(t *testing.T) {
+	tests := []struct {
+		value     interface{}
+		code      MsgCodeT
+		valid     bool
+	}{
+		{int(5), 5, true},
+		{int8(math.MaxInt8), math.MaxInt8, true},
+		{int16(math.MaxInt16), math.MaxInt16, true},
+		{int32(math.MaxInt32), math.MaxInt32, true},
+		{int64(math.MaxInt64), math.MaxInt64, true},
+		{uint(5), 5, true},
+		{uint8(math.MaxUint8), math.MaxUint8, true},
+		{uint16(math.MaxUint16), math.MaxUint16, true},
+		{uint32(math.MaxUint32), math.MaxUint32, true},
+		{uint64(math.MaxUint64), math.MaxUint64, true},
+		{float32(3), 3, true},
+		{float64(200), 200, true},
+		{math.Exp2(63), 1 << 63, true},
+		{json.Number("42"), 42, true},
+		{json.Number("4.0"), 4, true},
+		{json.Number("1e3"), 1000, true},
+		{json.Number("18446744073709551615"), math.MaxUint64, true},
+		{"7", 7, true},
+		{[]uint8("9"), 9, true},
+
+		// negative values
+		{int(-1), 0, false},
+		{int8(math.MinInt8), 0, false},
+		{int64(math.MinInt64), 0, false},
+		{float64(-1), 0, false},
+		{json.Number("-1"), 0, false},
+		{"-1", 0, false},
+		// non-integral values
+		{float32(2.5), 0, false},
+		{float64(0.1), 0, false},
+		{json.Number("2.5"), 0, false},
+		{"2.5", 0, false},
+		{math.NaN(), 0, false},
+		{math.Inf(1), 0, false},
+		{math.Inf(-1), 0, false},
+		// values of 2^64 and above
+		{math.Exp2(64), 0, false},
+		{float64(math.MaxUint64), 0, false},
+		{float32(math.MaxFloat32), 0, false},
+		{json.Number("18446744073709551616"), 0, false},
+		{"1e20", 0, false},
+		// values that are not numbers
+		{"", 0, false},
+		{"seven", 0, false},
+		{json.Number("NaN"), 0, false},
+		{nil, 0, false},
+		{true, 0, false},
+		{[]interface{}{1}, 0, false},
+		{map[string]interface{}{"code": 1}, 0, false},
+	}
+	for _, test := range tests {
+		code, e := ConvertToMsgCode(test.value)
+		if test.valid && (e != nil || code != test.code) {
+			t.Errorf("%T %v converted to %d with error %v, expected %d", test.value, test.value, code, e, test.code)
+		}
+		if test.valid == false && e == nil {
+			t.Errorf("%T %v converted to %d, expected an error", test.value, test.value, code)
+		}
+	}
+}
+
+func TestConvertToString(t *testing.T) {
+	tests := []struct {
+		value     interface{}
+		str       string
+		valid     bool
+	}{
+		{"text", "text", true},
+		{"", "", true},
+		{[]uint8("raw"), "raw", true},
+		{[]uint8{}, "", true},
+		{nil, "", false},
+		{5, "", false},
+		{'a', "", false},
+		{[]interface{}{"text"}, "", false},
+	}
+	for _, test := range tests {
+		str, e := ConvertToString(test.value)
+		if test.valid && (e != nil || str != test.str) {
+			t.Errorf("%T %v converted to %q with error %v, expected %q", test.value, test.value, str, e, test.str)
+		}
+		if test.valid == false && e == nil {
+			t.Errorf("%T %v converted to %q, expected an error", test.value, test.value, str)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+/*
+* wire.go
+*
+* Dripline messages can be put on the wire in two formats.
+*
+* In the v1 format every element of the message (msgtype, timestamp, sender_info, payload, and so on) is encoded together in the body.
+* In the v2 format the message metadata is carried in the AMQP application headers, and only the payload is encoded in the body.
+*
+* Incoming messages are accepted in either format: a message whose headers contain "message_type" is read as v2.
+ */
+
+package dripline
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+	"github.com/pborman/uuid"
+)
+
+// WireVersion selects the format in which messages are sent.
+type WireVersion int
+
+const (
+	// WireV1 encodes the whole message in the body.
+	WireV1 WireVersion = 1
+	// WireV2 carries the message metadata in the AMQP headers, and encodes only the payload in the body.
+	WireV2 WireVersion = 2
+)
+
+// v2HeaderNames maps the elements of a v1 message body to the names of the v2 headers that carry them.
+var v2HeaderNames = map[string]string {
+	"msgtype":     "message_type",
+	"msgop":       "message_operation",
+	"retcode":     "return_code",
+	"return_msg":  "return_message",
+	"specifier":   "specifier",
+	"lockout_key": "lockout_key",
+	"timestamp":   "timestamp",
+	"sender_info": "sender_info",
+}
+
+// v1ElementNames is the reverse of v2HeaderNames.
+var v1ElementNames = reverseNames(v2HeaderNames)
+
+func reverseNames(names map[string]string) (reversed map[string]string) {
+	reversed = make(map[string]string, len(names))
+	for from, to := range names {
+		reversed[to] = from
+	}
+	return
+}
+
+// encodable is implemented by the four message types.
+type encodable interface {
+	base() *Message
+	elements() map[string]interface{}
+}
+
+func (message *Message) base() *Message {
+	return message
+}
+
+// isV2 reports whether a message with the given headers uses the v2 format.
+func isV2(headers amqp.Table) bool {
+	_, hasType := headers[v2HeaderNames["msgtype"]]
+	return hasType
+}
+
+// encodePublishing puts a message into an AMQP publishing in the given wire format.
+// A message that does not have a correlation ID is given one.
+func encodePublishing(toSend encodable, version WireVersion) (publishing amqp.Publishing, e error) {
+	message := toSend.base()
+	buffer := toSend.elements()
+
+	correlationId := (*message).CorrId
+	if correlationId == "" {
+		correlationId = uuid.New()
+	}
+	publishing = amqp.Publishing {
+		ContentEncoding: (*message).Encoding,
+		ReplyTo:         (*message).ReplyTo,
+		CorrelationId:   correlationId,
+	}
+
+	switch version {
+	case WireV1:
+		publishing.Body, e = encodeBuffer(&buffer, (*message).Encoding)
+	case WireV2:
+		publishing.Headers, publishing.Body, e = encodeV2(buffer, (*message).Encoding)
+	default:
+		e = fmt.Errorf("Unknown wire version %d", version)
+	}
+	return
+}
+
+// encodeV2 splits the elements of a message into the v2 headers and the encoded payload.
+func encodeV2(buffer map[string]interface{}, encoding string) (headers amqp.Table, body []byte, e error) {
+	bodyCodec, registered := LookupCodec(encoding)
+	if registered == false {
+		e = Errorf(RCErrDripNoEnc, "Message content cannot be encoded with type <%s>", encoding)
+		return
+	}
+
+	headers = make(amqp.Table, len(buffer))
+	for element, value := range buffer {
+		if element == "payload" {
+			continue
+		}
+		header, known := v2HeaderNames[element]
+		if known == false {
+			header = element
+		}
+		headers[header] = headerValue(value)
+	}
+
+	if body, e = bodyCodec.Marshal(buffer["payload"]); e != nil {
+		e = fmt.Errorf("Unable to encode %s-encoded payload: %v", encoding, e)
+	}
+	return
+}
+
+// headerValue converts a message element to a type that can be sent in an AMQP header table.
+func headerValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case MsgCodeT:
+		return int64(val)
+	case uint:
+		return int64(val)
+	case uint16:
+		return int64(val)
+	case uint32:
+		return int64(val)
+	case uint64:
+		return int64(val)
+	case map[string]interface{}:
+		table := make(amqp.Table, len(val))
+		for key, elem := range val {
+			table[key] = headerValue(elem)
+		}
+		return table
+	case []interface{}:
+		array := make([]interface{}, len(val))
+		for i, elem := range val {
+			array[i] = headerValue(elem)
+		}
+		return array
+	default:
+		return value
+	}
+}
+
+// decodeV2 assembles the elements of a v2 message from its headers and (uncompressed) body,
+// under the names that they have in a v1 message body.
+func decodeV2(headers amqp.Table, body []byte, encoding string) (buffer map[string]interface{}, e error) {
+	buffer = make(map[string]interface{}, len(headers) + 1)
+	for header, value := range headers {
+		element, known := v1ElementNames[header]
+		if known == false {
+			element = header
+		}
+		buffer[element] = elementValue(value)
+	}
+
+	if len(body) == 0 {
+		buffer["payload"] = nil
+		return
+	}
+	bodyCodec, registered := LookupCodec(encoding)
+	if registered == false {
+		e = Errorf(RCErrDripNoEnc, "Message content encoding is not understood: %s", encoding)
+		return
+	}
+	var payload interface{}
+	if decodeErr := bodyCodec.Unmarshal(body, &payload); decodeErr != nil {
+		e = Errorf(RCErrDripDecFail, "Unable to decode %s-encoded payload: %v", encoding, decodeErr)
+		return
+	}
+	buffer["payload"] = payload
+	return
+}
+
+// elementValue converts an AMQP header value into the generic types of a decoded message body.
+func elementValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case amqp.Table:
+		elements := make(map[string]interface{}, len(val))
+		for key, elem := range val {
+			elements[key] = elementValue(elem)
+		}
+		return elements
+	case []interface{}:
+		elements := make([]interface{}, len(val))
+		for i, elem := range val {
+			elements[i] = elementValue(elem)
+		}
+		return elements
+	default:
+		return value
+	}
+}
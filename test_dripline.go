@@ -24,14 +24,18 @@ func main() {
 	// user needs help
 	var needHelp bool
 
-	// RabbitMQ broker user and password
-	var user, password string
+	// RabbitMQ broker address, user and password
+	var broker, user, password string
+
+	// run without a RabbitMQ broker
+	var useMemory bool
 
 	// set up flag to point at conf, parse arguments and then verify
 	flag.BoolVar(&needHelp, "help", false, "Display this dialog")
 	flag.StringVar(&user, "user", "", "RabbitMQ broker user")
 	flag.StringVar(&password, "pword", "", "RabbitMQ broker password")
 	flag.StringVar(&broker, "broker", "", "RabbitMQ broker")
+	flag.BoolVar(&useMemory, "memory", false, "Use an in-process broker instead of RabbitMQ")
 	flag.Parse()
 
 	if needHelp {
@@ -41,10 +45,23 @@ func main() {
 
 	url := "amqp://" + user + ":" + password + "@" + broker
 
+	// startService starts a service on either RabbitMQ or the in-process broker
+	memoryBroker := dripline.NewMemoryBroker()
+	startService := func(queueName string) *dripline.AmqpService {
+		if ! useMemory {
+			return dripline.StartService(url, queueName)
+		}
+		service := dripline.ServiceDefaults()
+		service.Receiver.QueueName = queueName
+		service.Transport = memoryBroker.NewTransport()
+		service.StartService()
+		return service
+	}
+
 	// Bob will be receiving a message from Alice.
 	// Start a goroutine to handle and reply to that message
 	go func(){
-		bob := dripline.StartService(url, "dt_bob")
+		bob := startService("dt_bob")
 		if (bob == nil) {
 			logging.Log.Critical("Bob did not start")
 			return
@@ -76,7 +93,7 @@ func main() {
 	// pause to make sure Bob is ready
 	time.Sleep(5 * time.Second)
 
-	alice := dripline.StartService(url, "")
+	alice := startService("")
 	if (alice == nil) {
 		logging.Log.Critical("Alice did not start")
 		return
@@ -86,7 +103,7 @@ func main() {
 	// Alice sends a request to Bob
 	senderInfo := dripline.PrepareSenderInfo("dripline", "dripline_test", "0.0", "abcdefg", "localhost", "Alice")
 	request := dripline.PrepareRequest("dt_bob", "application/json", dripline.MOCommand, senderInfo)
-	replyChan, sendErr := alice.SendRequest(request)
+	replyChan, sendErr := alice.SendRequest(request, 10 * time.Second)
 	if sendErr != nil {
 		logging.Log.Criticalf("Alice could not send the request: %v", sendErr)
 		return
@@ -99,4 +116,4 @@ func main() {
 
 	alice.Stop()
 	logging.Log.Info("Alice has stopped")
-}
\ No newline at end of file
+}